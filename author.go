@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An entry in config.authors. Plain strings behave like the --author option of
+// git-log and are matched as a regex against "Name <email>". Objects match
+// exactly on name and/or email, or on a regex, and every field provided must
+// match.
+type AuthorConfig struct {
+	Pattern string
+	Name    string
+	Email   string
+	Regex   string
+
+	regex *regexp.Regexp
+}
+
+func (author *AuthorConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		author.Pattern = node.Value
+	} else {
+		fields := struct {
+			Name  string
+			Email string
+			Regex string
+		}{}
+
+		err := unknownFields(node, reflect.TypeOf(fields))
+		if err != nil {
+			return err
+		}
+
+		err = node.Decode(&fields)
+		if err != nil {
+			return err
+		}
+
+		author.Name = fields.Name
+		author.Email = fields.Email
+		author.Regex = fields.Regex
+	}
+
+	pattern := author.Regex
+	if len(author.Pattern) != 0 {
+		pattern = author.Pattern
+	}
+
+	if len(pattern) != 0 {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("line %d: author pattern \"%s\" failed to compile to regex: %w", node.Line, pattern, err)
+		}
+
+		author.regex = regex
+	}
+
+	if author.regex == nil && len(author.Name) == 0 && len(author.Email) == 0 {
+		return fmt.Errorf("line %d: author must provide at least one of name, email, or regex", node.Line)
+	}
+
+	return nil
+}
+
+func (author AuthorConfig) String() string {
+	if len(author.Pattern) != 0 {
+		return author.Pattern
+	}
+
+	parts := []string{}
+
+	if len(author.Name) != 0 {
+		parts = append(parts, "name="+author.Name)
+	}
+
+	if len(author.Email) != 0 {
+		parts = append(parts, "email="+author.Email)
+	}
+
+	if len(author.Regex) != 0 {
+		parts = append(parts, "regex="+author.Regex)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (author AuthorConfig) matches(identity Identity) bool {
+	if len(author.Name) != 0 && !strings.EqualFold(author.Name, identity.Name) {
+		return false
+	}
+
+	if len(author.Email) != 0 && !strings.EqualFold(author.Email, identity.Email) {
+		return false
+	}
+
+	if author.regex != nil && !author.regex.MatchString(identity.String()) {
+		return false
+	}
+
+	return true
+}
+
+type Identity struct {
+	Name  string
+	Email string
+}
+
+func (identity Identity) String() string {
+	return fmt.Sprintf("%s <%s>", identity.Name, identity.Email)
+}
+
+// Parses a "Name <email>" contact, as found in Co-authored-by trailers.
+func parseIdentity(contact string) (Identity, bool) {
+	contact = strings.TrimSpace(contact)
+	open := strings.LastIndex(contact, "<")
+
+	if open == -1 || !strings.HasSuffix(contact, ">") {
+		return Identity{}, false
+	}
+
+	return Identity{
+		Name:  strings.TrimSpace(contact[:open]),
+		Email: contact[open+1 : len(contact)-1],
+	}, true
+}
+
+// Returns the first configured author matching identity, if any.
+func (repo *Repo) matchAuthor(identity Identity) (AuthorConfig, bool) {
+	for _, author := range repo.Config.Authors {
+		if author.matches(identity) {
+			return author, true
+		}
+	}
+
+	return AuthorConfig{}, false
+}
+
+// Resolves contacts through the repository's .mailmap, the same way git does
+// for %aN and %aE.
+func (repo *Repo) mapIdentities(contacts []string) map[string]Identity {
+	ret := map[string]Identity{}
+	valid := []string{}
+
+	for _, contact := range contacts {
+		if identity, ok := parseIdentity(contact); ok {
+			ret[contact] = identity
+			valid = append(valid, identity.String())
+		}
+	}
+
+	if len(valid) == 0 {
+		return ret
+	}
+
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, append([]string{"check-mailmap"}, valid...)...)
+	if err != nil {
+		log(Warning, repo, fmt.Sprintf("Unable to resolve co-authors through .mailmap: %s", err.Error()))
+		return ret
+	}
+
+	mapped := strings.Split(strings.TrimRight(stdout, "\n"), "\n")
+	if len(mapped) != len(valid) {
+		log(Warning, repo, "git check-mailmap returned an unexpected number of contacts, ignoring .mailmap for co-authors")
+		return ret
+	}
+
+	i := 0
+	for _, contact := range contacts {
+		if _, ok := ret[contact]; !ok {
+			continue
+		}
+
+		if identity, ok := parseIdentity(mapped[i]); ok {
+			ret[contact] = identity
+		}
+
+		i++
+	}
+
+	return ret
+}
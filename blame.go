@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The counting mode selected by config.indepth. false counts every line of the
+// latest commit, true counts the diffs of matching commits, and "blame" counts
+// the lines of the latest commit which were last changed by a matching author.
+type IndepthMode uint8
+
+const (
+	IndepthOff IndepthMode = iota
+	IndepthCommits
+	IndepthBlame
+)
+
+func (mode *IndepthMode) UnmarshalYAML(node *yaml.Node) error {
+	var enabled bool
+	if err := node.Decode(&enabled); err == nil {
+		if enabled {
+			*mode = IndepthCommits
+		} else {
+			*mode = IndepthOff
+		}
+
+		return nil
+	}
+
+	if node.Value == "blame" {
+		*mode = IndepthBlame
+		return nil
+	}
+
+	return fmt.Errorf("line %d: indepth must be true, false, or \"blame\", got %s", node.Line, node.Value)
+}
+
+func (mode IndepthMode) String() string {
+	switch mode {
+	case IndepthOff:
+		return "false"
+	case IndepthCommits:
+		return "true"
+	case IndepthBlame:
+		return "blame"
+	default:
+		return fmt.Sprintf("%d", int(mode))
+	}
+}
+
+type treeEntry struct {
+	File string
+	Blob string
+}
+
+// Lists the regular files of the checked out tree along with their blob
+// hashes. Symlinks and submodules are left out.
+func (repo *Repo) getTreeEntries() ([]treeEntry, error) {
+	return repo.getTreeEntriesAt("HEAD")
+}
+
+// Lists the regular files of the tree of rev, see getTreeEntries.
+func (repo *Repo) getTreeEntriesAt(rev string) ([]treeEntry, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "ls-tree", "-r", "-z", rev)
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+
+	ret := []treeEntry{}
+
+	for _, record := range strings.Split(stdout, "\x00") {
+		// <mode> SP <type> SP <object> TAB <file>
+		meta, file, found := strings.Cut(record, "\t")
+		if !found {
+			continue
+		}
+
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+
+		ret = append(ret, treeEntry{File: file, Blob: fields[2]})
+	}
+
+	return ret, nil
+}
+
+// Counts the lines and bytes of a file last changed by a matching author,
+// according to git blame.
+func (repo *Repo) blameFile(file string) (LineBytePair, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "blame", "--porcelain", "HEAD", "--", file)
+	if err != nil {
+		return LineBytePair{}, fmt.Errorf("blaming %s: %w", file, err)
+	}
+
+	ret := LineBytePair{}
+	owned := map[string]bool{}
+	authors := map[string]Identity{}
+	var current string
+
+	for _, line := range strings.Split(stdout, "\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] == '\t' {
+			content := line[1:]
+
+			if !owned[current] || (!repo.Config.CountSpaces && len(strings.TrimSpace(content)) == 0) {
+				continue
+			}
+
+			ret.Lines++
+			ret.Bytes += len(content)
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+
+		switch key {
+		case "author":
+			identity := authors[current]
+			identity.Name = value
+			authors[current] = identity
+		case "author-mail":
+			identity := authors[current]
+			identity.Email = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+			authors[current] = identity
+
+			// author-mail always follows author
+			author, ok := repo.matchAuthor(identity)
+			owned[current] = ok
+
+			if ok {
+				log(Debug, repo, fmt.Sprintf("Blamed commit %s in %s authored by %s, matched author %s", current, file, identity, author))
+			}
+		default:
+			// Each group of lines starts with <hash> <orig line> <final line>
+			if len(key) >= 40 && strings.Count(line, " ") >= 2 {
+				current = key
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func (repo *Repo) countByBlame() (map[string]*LineBytePair, error) {
+	ret := map[string]*LineBytePair{}
+	repo.BlameCache = map[string]LineBytePair{}
+
+	var oldCache map[string]LineBytePair
+	if repo.cacheUsable("blame", blameCacheSettings) {
+		oldCache = repo.oldRepo.BlameCache
+	}
+
+	entries, err := repo.getTreeEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	elen := float64(len(entries))
+
+	for i, entry := range entries {
+		if err := repo.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		msg := fmt.Sprintf("Blaming file %s", entry.File)
+		logProgess(repo, msg, float64(i)/elen)
+		log(Info, repo, msg)
+
+		if repo.shouldSkipFileByName(entry.File) {
+			continue
+		}
+
+		data, err := os.ReadFile(path.Join(repo.Path, entry.File))
+		if err != nil {
+			return nil, err
+		}
+
+		if repo.skipFileByData(entry.File, data) {
+			continue
+		}
+
+		// Blame follows the history of the path, so identical blobs at
+		// different paths, e.g. copies, may be owned by different authors
+		key := entry.Blob + " " + entry.File
+		owned, ok := oldCache[key]
+		if ok {
+			log(Info, repo, fmt.Sprintf("Using cached blame for file %s (blob %s)", entry.File, entry.Blob))
+		} else {
+			owned, err = repo.blameFile(entry.File)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		repo.BlameCache[key] = owned
+
+		if owned.Lines == 0 && owned.Bytes == 0 {
+			continue
+		}
+
+		langs := repo.getLanguages(entry.File, data)
+		if len(langs) > 1 {
+			log(Warning, repo, fmt.Sprintf("Potentially multiple languages found for file %s: %s", entry.File, langs))
+		}
+
+		if len(langs) == 0 {
+			langs = append(langs, "Unknown")
+		}
+
+		if !repo.shouldSkipLang(langs[0]) {
+			repo.insertUniqueFile(entry.File)
+		}
+
+		pair := ret[langs[0]]
+		if pair == nil {
+			pair = &LineBytePair{}
+			ret[langs[0]] = pair
+		}
+
+		pair.Lines += owned.Lines
+		pair.Bytes += owned.Bytes
+	}
+
+	log(Info, repo, "Finished")
+	logProgess(repo, "Finished", 1)
+
+	repo.LangCounts = ret
+	return ret, nil
+}
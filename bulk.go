@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Heuristics for bulk commits (imports, vendoring, reformatting) which would
+// otherwise dwarf the rest of a repository's in-depth counts.
+type BulkConfig struct {
+	MaxLines   int
+	MaxFiles   int
+	Action     string
+	Renames    bool
+	Whitespace bool
+	Messages   []string
+
+	messages []*regexp.Regexp
+}
+
+func (bulk *BulkConfig) compile(repoName string) error {
+	switch bulk.Action {
+	case "":
+		bulk.Action = "skip"
+	case "skip", "cap":
+	default:
+		return configErrorf("config.repositories[%s].bulk.action must be either skip or cap", repoName)
+	}
+
+	if bulk.MaxLines < 0 || bulk.MaxFiles < 0 {
+		return configErrorf("config.repositories[%s].bulk.maxlines and bulk.maxfiles must not be negative", repoName)
+	}
+
+	bulk.messages = []*regexp.Regexp{}
+	for _, pattern := range bulk.Messages {
+		regex, err := compilePattern(pattern, "bulk.messages")
+		if err != nil {
+			return err
+		}
+
+		bulk.messages = append(bulk.messages, regex)
+	}
+
+	return nil
+}
+
+// Returns the pattern matching the commit's subject, or an empty string.
+func (bulk *BulkConfig) matchMessage(commit Commit) string {
+	for _, regex := range bulk.messages {
+		if regex.MatchString(commit.Subject) {
+			return regex.String()
+		}
+	}
+
+	return ""
+}
+
+// Decides how much of a commit to count from its diffs, after files have been
+// filtered. Returns the factor to scale the commit's counts by, 0 if it should
+// be skipped entirely, along with the reason when it is not counted in full.
+func (bulk *BulkConfig) scale(diffs []Diff, unfiltered int) (float64, string) {
+	if bulk.Whitespace && unfiltered == 0 {
+		return 0, "no changes once whitespace is ignored"
+	}
+
+	if len(diffs) == 0 {
+		return 1, ""
+	}
+
+	changed := 0
+	renames := 0
+	for _, diff := range diffs {
+		lines := diff.Added.Lines + diff.Removed.Lines
+		changed += lines
+
+		if diff.Renamed && lines == 0 {
+			renames++
+		}
+	}
+
+	if bulk.Renames && renames == len(diffs) {
+		return 0, "only renames or moves"
+	}
+
+	// Both limits are reported when both are exceeded, the smaller scale wins
+	scale := 1.0
+	reasons := []string{}
+
+	if bulk.MaxLines != 0 && changed > bulk.MaxLines {
+		scale = min(scale, float64(bulk.MaxLines)/float64(changed))
+		reasons = append(reasons, fmt.Sprintf("%d changed lines exceeds bulk.maxlines (%d)", changed, bulk.MaxLines))
+	}
+
+	if bulk.MaxFiles != 0 && len(diffs) > bulk.MaxFiles {
+		scale = min(scale, float64(bulk.MaxFiles)/float64(len(diffs)))
+		reasons = append(reasons, fmt.Sprintf("%d changed files exceeds bulk.maxfiles (%d)", len(diffs), bulk.MaxFiles))
+	}
+
+	reason := strings.Join(reasons, " and ")
+
+	if len(reason) != 0 && bulk.Action == "skip" {
+		return 0, reason
+	}
+
+	return scale, reason
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// The changes a single commit made to files of one language
+type CommitLangResult struct {
+	Added   LineBytePair
+	Removed LineBytePair
+	Files   []string
+}
+
+// The analyzed changes of a single commit, cached in the state so that only
+// new or rewritten commits have to be checked out and diffed again
+type CommitResult struct {
+	Langs map[string]*CommitLangResult
+	// Scale and Reason returned by the bulk heuristics, a Scale of 0 means the
+	// commit is skipped
+	Scale  float64
+	Reason string
+}
+
+// The classification of a file in snapshot mode, cached by blob hash and path
+// since the path decides the language and which filters apply
+type SnapshotFile struct {
+	Skipped bool
+	Lang    string
+	Lines   int
+	Bytes   int
+}
+
+// The settings each cache depends on, see Repo.settingsFingerprint. Settings
+// applied when combining commit results (authors, weights, counttotal,
+// ignore.langs) are left out of commitCacheSettings, as they do not change
+// the result of analyzing a single commit. Blame only matches the author of
+// each line against config.authors, as resolved through .mailmap. Trailers
+// are never read, so coauthors and coauthorweight are left out.
+var commitCacheSettings = []string{"ignore", "excludes", "languages", "countspaces", "merges", "bulk", "vendored"}
+var blameCacheSettings = []string{"authors", "mailmap", "countspaces"}
+var snapshotCacheSettings = []string{"ignore", "excludes", "languages", "vendored"}
+
+// Hashes each setting which influences a repository's counts, so that cached
+// results can be discarded when the settings they depend on change.
+func (repo *Repo) settingsFingerprint() (map[string]string, error) {
+	vendored := []string{}
+	for _, regex := range repo.VendoredFilters {
+		vendored = append(vendored, regex.String())
+	}
+
+	ignore := repo.Config.Ignore
+	ignore.Langs = nil
+
+	// git blame reads the .mailmap of the checked out tree
+	mailmap, err := os.ReadFile(path.Join(repo.Path, ".mailmap"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading .mailmap: %w", err)
+	}
+
+	settings := map[string]any{
+		"indepth":        repo.Config.Indepth,
+		"ref":            repo.Config.Ref,
+		"allbranches":    repo.Config.AllBranches,
+		"merges":         repo.Config.Merges,
+		"since":          repo.Config.since,
+		"until":          repo.Config.until,
+		"authors":        repo.Config.Authors,
+		"coauthors":      repo.Config.CoAuthors,
+		"coauthorweight": repo.Config.CoAuthorWeight,
+		"mailmap":        string(mailmap),
+		"commits":        config.Commits,
+		"ignore":         ignore,
+		"ignore.langs":   repo.Config.Ignore.Langs,
+		"excludes":       repo.Config.Excludes,
+		"languages":      repo.Config.Languages,
+		"countspaces":    repo.Config.CountSpaces,
+		"counttotal":     repo.Config.CountTotal,
+		"bulk":           repo.Config.Bulk,
+		"vendored":       vendored,
+	}
+
+	ret := map[string]string{}
+	for name, value := range settings {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("hashing setting %s: %w", name, err)
+		}
+
+		ret[name] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	return ret, nil
+}
+
+// Compares the repository's settings with those its cached state was computed
+// with, logging which changed.
+func (repo *Repo) compareFingerprint() error {
+	fingerprint, err := repo.settingsFingerprint()
+	if err != nil {
+		return err
+	}
+
+	repo.Fingerprint = fingerprint
+
+	if repo.oldRepo == nil {
+		return nil
+	}
+
+	if len(repo.oldRepo.Fingerprint) == 0 {
+		log(Info, repo, "Cached state has no settings fingerprint, recounting")
+		repo.oldRepo = nil
+		return nil
+	}
+
+	repo.changedSettings = []string{}
+	for name, hash := range repo.Fingerprint {
+		if repo.oldRepo.Fingerprint[name] != hash {
+			repo.changedSettings = append(repo.changedSettings, name)
+		}
+	}
+
+	if len(repo.changedSettings) != 0 {
+		slices.Sort(repo.changedSettings)
+		log(Info, repo, fmt.Sprintf("Settings changed since the last run: %s", strings.Join(repo.changedSettings, ", ")))
+	}
+
+	return nil
+}
+
+// Returns which of settings changed since the cached state was computed.
+func (repo *Repo) cacheChanged(settings []string) []string {
+	changed := []string{}
+	for _, setting := range settings {
+		if slices.Contains(repo.changedSettings, setting) {
+			changed = append(changed, setting)
+		}
+	}
+
+	return changed
+}
+
+// Reports whether cached state computed with the same values of settings is
+// available, logging why not if it was discarded.
+func (repo *Repo) cacheUsable(name string, settings []string) bool {
+	if repo.oldRepo == nil {
+		return false
+	}
+
+	changed := repo.cacheChanged(settings)
+
+	if len(changed) != 0 {
+		log(Info, repo, fmt.Sprintf("Discarding cached %s, %s changed", name, strings.Join(changed, ", ")))
+		return false
+	}
+
+	return true
+}
+
+// Combines the cache entries of a repository whose count was interrupted with
+// the old entries which are still valid.
+func mergeCache[V any](old map[string]V, current map[string]V, usable bool) map[string]V {
+	ret := map[string]V{}
+
+	if usable {
+		maps.Copy(ret, old)
+	}
+
+	maps.Copy(ret, current)
+
+	return ret
+}
+
+// The state of a repository whose count was interrupted. Only the per-commit
+// and per-file caches are kept, so that the next run recounts the repository
+// without redoing the work already done.
+func (repo *Repo) partialState() SerializedRepo {
+	usable := func(settings []string) bool {
+		return repo.oldRepo != nil && len(repo.cacheChanged(settings)) == 0
+	}
+
+	var old SerializedRepo
+	if repo.oldRepo != nil {
+		old = *repo.oldRepo
+	}
+
+	return SerializedRepo{
+		ObjectFormat:  repo.ObjectFormat,
+		Merges:        repo.Config.Merges,
+		BlameCache:    mergeCache(old.BlameCache, repo.BlameCache, usable(blameCacheSettings)),
+		CommitCache:   mergeCache(old.CommitCache, repo.CommitCache, usable(commitCacheSettings)),
+		SnapshotCache: mergeCache(old.SnapshotCache, repo.SnapshotCache, usable(snapshotCacheSettings)),
+		Fingerprint:   repo.Fingerprint,
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func cacheMain(args []string) {
+	var dryRun = false
+	var force = false
+	var clone = false
+
+	fs := newFlagSet("cache", `
+Inspect and manage the cached state and the clones in config.location
+
+Usage: ./ppebtrics cache <list|prune|clear|verify> [OPTIONS]
+  list                 List cached repositories and clones, with the last
+                       analyzed commit, size on disk, and age
+  prune                Delete clones and cached state of repositories which
+                       are no longer configured
+  clear <repo>...      Delete the cached state of the given repositories
+  verify               Check the cached state against each clone's history
+
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+ -d|--dry-run          Only print what prune or clear would delete
+ -f|--force            Ignore the lock, run even if another instance holds it
+    --clone            Also delete the clones of the repositories cleared
+`)
+
+	configPath := configFlag(fs)
+	boolFlag(fs, &dryRun, "dry-run", "d")
+	boolFlag(fs, &force, "force", "f")
+	boolFlag(fs, &clone, "clone", "")
+
+	positional := parseFlags(fs, args)
+
+	var action string
+	var repos []string
+	if len(positional) != 0 {
+		action = positional[0]
+		repos = positional[1:]
+	}
+
+	var err error
+
+	switch action {
+	case "list", "prune", "verify":
+		if len(repos) != 0 {
+			err = configErrorf("cache %s does not take any repositories", action)
+		}
+	case "clear":
+		if len(repos) == 0 {
+			err = configErrorf("cache clear requires at least one repository")
+		}
+
+		for _, id := range repos {
+			if err == nil {
+				err = checkRepoID(id)
+			}
+		}
+	case "":
+		err = configErrorf("no cache command provided, see ./ppebtrics cache --help")
+	default:
+		err = configErrorf("unknown cache command %s, see ./ppebtrics cache --help", action)
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if !cacheRun(resolveConfigPath(*configPath), action, repos, dryRun, force, clone) {
+		os.Exit(1)
+	}
+}
+
+// Runs a cache command under the lock, returns false if it failed.
+func cacheRun(configPath string, action string, repos []string, dryRun bool, force bool, clone bool) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := initLog(false)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	defer logClose()
+	defer logResetCursor()
+	handleSignals(cancel)
+
+	if action == "prune" {
+		err = initConfig(configPath)
+	} else {
+		err = loadConfig(configPath)
+	}
+
+	if err == nil {
+		err = createDirs()
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	err = lock(force)
+	if err != nil {
+		logEcho(Critical, nil, err.Error(), true)
+		return false
+	}
+
+	defer func() {
+		if err := unlock(); err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Failed to remove lockfile: %s", err), true)
+		}
+	}()
+
+	state := State{}
+	err = state.read()
+	if os.IsNotExist(err) {
+		state.Repos = map[string]SerializedRepo{}
+	} else if err != nil {
+		logEcho(Critical, nil, fmt.Sprintf("Unable to read state: %s", err), true)
+		return false
+	}
+
+	ok := true
+	changed := false
+
+	switch action {
+	case "list":
+		err = cacheList(&state)
+	case "prune":
+		changed, err = cachePrune(&state, dryRun)
+	case "clear":
+		changed, err = cacheClear(&state, repos, clone, dryRun)
+	case "verify":
+		ok = cacheVerify(ctx, &state)
+	}
+
+	if err != nil {
+		logEcho(Critical, nil, err.Error(), true)
+		ok = false
+	}
+
+	if changed && !dryRun {
+		err = state.write()
+		if err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Error writing data: %s", err.Error()), true)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// Lists the directories in config.location which are git clones.
+func listClones() ([]string, error) {
+	entries, err := os.ReadDir(config.Location)
+	if err != nil {
+		return nil, fmt.Errorf("listing clones: %w", err)
+	}
+
+	ret := []string{}
+	for _, entry := range entries {
+		dir := path.Join(config.Location, entry.Name())
+
+		if entry.IsDir() && fileExists(path.Join(dir, ".git")) {
+			ret = append(ret, dir)
+		}
+	}
+
+	return ret, nil
+}
+
+func dirSize(dir string) int {
+	size := 0
+
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += int(info.Size())
+			}
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+func fmtAge(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+
+	age := time.Since(t)
+
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+}
+
+func cacheList(state *State) error {
+	ids := make([]string, 0, len(state.Repos))
+	for id := range state.Repos {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tHEAD\tSIZE\tAGE")
+
+	seen := []string{}
+
+	for _, id := range ids {
+		repo := state.Repos[id]
+		dir := repoPath(id)
+		seen = append(seen, dir)
+
+		head := "-"
+		if len(repo.Head) != 0 {
+			head = repo.Head[:min(12, len(repo.Head))]
+		}
+
+		size := "no clone"
+		if fileExists(dir) {
+			size = fmtBytes(dirSize(dir), 1024) + "B"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, head, size, fmtAge(repo.Analyzed))
+	}
+
+	clones, err := listClones()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range clones {
+		if slices.Contains(seen, dir) {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t-\t%sB\tnot cached\n", path.Base(dir), fmtBytes(dirSize(dir), 1024))
+	}
+
+	return w.Flush()
+}
+
+func removeVerb(dryRun bool) string {
+	if dryRun {
+		return "Would remove"
+	}
+
+	return "Removing"
+}
+
+// Deletes the clones and cached state of repositories not in reposToCheck.
+func cachePrune(state *State, dryRun bool) (bool, error) {
+	changed := false
+	verb := removeVerb(dryRun)
+	configured := []string{}
+
+	for _, id := range reposToCheck {
+		configured = append(configured, repoPath(id))
+	}
+
+	for id := range state.Repos {
+		if slices.Contains(reposToCheck, id) {
+			continue
+		}
+
+		logEcho(Info, nil, fmt.Sprintf("%s cached state of %s", verb, id), true)
+		delete(state.Repos, id)
+		changed = true
+	}
+
+	clones, err := listClones()
+	if err != nil {
+		return changed, err
+	}
+
+	for _, dir := range clones {
+		if slices.Contains(configured, dir) {
+			continue
+		}
+
+		logEcho(Info, nil, fmt.Sprintf("%s clone %s", verb, dir), true)
+		if !dryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				return changed, err
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+func cacheClear(state *State, repos []string, clone bool, dryRun bool) (bool, error) {
+	changed := false
+	verb := removeVerb(dryRun)
+
+	for _, id := range repos {
+		dir := repoPath(id)
+		_, cached := state.Repos[id]
+
+		if !cached && !(clone && fileExists(dir)) {
+			logEcho(Warning, nil, fmt.Sprintf("Nothing is cached for %s", id), true)
+			continue
+		}
+
+		if cached {
+			logEcho(Info, nil, fmt.Sprintf("%s cached state of %s", verb, id), true)
+			delete(state.Repos, id)
+			changed = true
+		}
+
+		if clone && fileExists(dir) {
+			logEcho(Info, nil, fmt.Sprintf("%s clone %s", verb, dir), true)
+			if !dryRun {
+				if err := os.RemoveAll(dir); err != nil {
+					return changed, err
+				}
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// Checks each cached repository against its clone, reporting cached commits
+// and objects which no longer exist. Returns false if any problems were found.
+func cacheVerify(ctx context.Context, state *State) bool {
+	ids := make([]string, 0, len(state.Repos))
+	for id := range state.Repos {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	ok := true
+
+	for _, id := range ids {
+		problems := verifyRepo(ctx, id, state.Repos[id])
+
+		if len(problems) == 0 {
+			logEcho(Info, nil, fmt.Sprintf("%s: ok", id), true)
+			continue
+		}
+
+		ok = false
+		for _, problem := range problems {
+			logEcho(Warning, nil, fmt.Sprintf("%s: %s", id, problem), true)
+		}
+	}
+
+	if !ok {
+		logEcho(Warning, nil, "Run ./ppebtrics cache clear <repo> to discard the cached state of a repository", true)
+	}
+
+	return ok
+}
+
+func verifyRepo(ctx context.Context, id string, repo SerializedRepo) []string {
+	dir := repoPath(id)
+	if !fileExists(dir) {
+		return []string{fmt.Sprintf("no clone at %s", dir)}
+	}
+
+	problems := []string{}
+
+	if len(repo.Fingerprint) == 0 {
+		problems = append(problems, "cached state has no settings fingerprint and will be recounted")
+	}
+
+	stdout, _, err := runGitSync(ctx, dir, "rev-parse", "--show-object-format")
+	if err != nil {
+		return append(problems, fmt.Sprintf("unable to read the clone: %s", err))
+	}
+
+	if format := strings.TrimSpace(stdout); len(repo.ObjectFormat) != 0 && repo.ObjectFormat != format {
+		problems = append(problems, fmt.Sprintf("cached object format %s does not match the clone's %s", repo.ObjectFormat, format))
+	}
+
+	stdout, _, err = runGitSync(ctx, dir, "rev-list", "--all")
+	if err != nil {
+		return append(problems, fmt.Sprintf("unable to list the clone's history: %s", err))
+	}
+
+	history := map[string]bool{}
+	for _, hash := range strings.Fields(stdout) {
+		history[hash] = true
+	}
+
+	if len(repo.Head) != 0 && !history[repo.Head] {
+		problems = append(problems, fmt.Sprintf("cached head %s is not in the clone's history", repo.Head))
+	}
+
+	cached := map[string]bool{}
+	for _, hash := range repo.CommitHashes {
+		cached[hash] = true
+	}
+
+	for hash := range repo.CommitCache {
+		cached[hash] = true
+	}
+
+	missing := 0
+	for hash := range cached {
+		if !history[hash] {
+			missing++
+		}
+	}
+
+	if missing != 0 {
+		problems = append(problems, fmt.Sprintf("%d cached commits are not in the clone's history", missing))
+	}
+
+	if len(repo.SnapshotTree) == 0 && len(repo.BlameCache) == 0 {
+		return problems
+	}
+
+	stdout, _, err = runGitSync(ctx, dir, "cat-file", "--batch-all-objects", "--batch-check=%(objectname)")
+	if err != nil {
+		return append(problems, fmt.Sprintf("unable to list the clone's objects: %s", err))
+	}
+
+	objects := map[string]bool{}
+	for _, hash := range strings.Fields(stdout) {
+		objects[hash] = true
+	}
+
+	if len(repo.SnapshotTree) != 0 && !objects[repo.SnapshotTree] {
+		problems = append(problems, fmt.Sprintf("cached tree %s does not exist in the clone", repo.SnapshotTree))
+	}
+
+	missing = 0
+	for key := range repo.BlameCache {
+		blob, _, _ := strings.Cut(key, " ")
+		if !objects[blob] {
+			missing++
+		}
+	}
+
+	if missing != 0 {
+		problems = append(problems, fmt.Sprintf("%d cached blobs do not exist in the clone", missing))
+	}
+
+	return problems
+}
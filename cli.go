@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Every flag may also be set through the environment, the name of the
+// variable being the flag's long name prefixed with ENVPREFIX, e.g.
+// PPEBTRICS_NO_CACHE=true for --no-cache. Flags on the command line win.
+const ENVPREFIX = "PPEBTRICS_"
+
+type Command struct {
+	Name    string
+	Summary string
+	Run     func(args []string)
+}
+
+var commands []Command
+
+func init() {
+	commands = []Command{
+		{"run", "Clone and count every repository, then render the card (the default)", runMain},
+		{"list", "List the repositories which would be counted", listMain},
+		{"render", "Render the card from the cached counts, without fetching anything", renderMain},
+		{"explain", "Show how the files of a repository or a commit were classified", explainMain},
+		{"cache", "Inspect and manage the cached state and the clones", cacheMain},
+		{"history", "Print how language totals changed over previous runs", historyMain},
+		{"validate", "Check the config for mistakes without counting anything", validateMain},
+		{"themes", "List the available themes", themesMain},
+	}
+}
+
+func printHelp() {
+	fmt.Fprint(os.Stderr, `
+ppeb's git language metrics generator!!!
+
+Usage: ./ppebtrics [command] [OPTIONS]
+
+Commands:
+`)
+
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", cmd.Name, cmd.Summary)
+	}
+
+	fmt.Fprint(os.Stderr, `
+Options of run:
+`+runOptions+`
+Run ./ppebtrics <command> --help for the options of each command. Every option
+may also be set through the environment, e.g. PPEBTRICS_CONFIG=./config.yml or
+PPEBTRICS_NO_CACHE=true.
+`)
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "run"
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		printHelp()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			cmd.Run(args)
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %s!\n", name)
+	printHelp()
+	os.Exit(ExitConfig)
+}
+
+// A flag which may be passed several times, or as a comma separated list
+// through the environment
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Creates the flag set of a command, printing usage, the text of its help
+// message, on --help or a bad flag.
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+
+	return fs
+}
+
+// Registers a flag under both its long and short name. short may be empty.
+func stringFlag(fs *flag.FlagSet, p *string, long string, short string, value string) {
+	fs.StringVar(p, long, value, "")
+	if len(short) != 0 {
+		fs.StringVar(p, short, value, "")
+	}
+}
+
+func boolFlag(fs *flag.FlagSet, p *bool, long string, short string) {
+	fs.BoolVar(p, long, false, "")
+	if len(short) != 0 {
+		fs.BoolVar(p, short, false, "")
+	}
+}
+
+func configFlag(fs *flag.FlagSet) *string {
+	configPath := new(string)
+	stringFlag(fs, configPath, "config", "c", "")
+
+	return configPath
+}
+
+// ./config.yml if it exists, otherwise config.yml in the user's config
+// directory, e.g. ~/.config/ppebtrics/config.yml
+func defaultConfigPath() string {
+	if fileExists("config.yml") {
+		return "config.yml"
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yml"
+	}
+
+	return path.Join(dir, "ppebtrics", "config.yml")
+}
+
+func envName(flagName string) string {
+	return ENVPREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Applies the environment to fs, then parses args, returning the positional
+// arguments. Flags may come before, between, or after positional arguments.
+// Exits on --help or a bad flag.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	fs.VisitAll(func(f *flag.Flag) {
+		// Short names share their value with the long name
+		if len(f.Name) == 1 {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(*stringList); ok {
+			values = strings.Split(value, ",")
+		}
+
+		for _, value := range values {
+			if err := fs.Set(f.Name, strings.TrimSpace(value)); err != nil {
+				exitWithError(configErrorf("invalid value %q for %s: %w", value, envName(f.Name), err))
+			}
+		}
+	})
+
+	positional := []string{}
+
+	for {
+		err := fs.Parse(args)
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		} else if err != nil {
+			// Already printed along with the usage
+			os.Exit(ExitConfig)
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// The value of --config, or the default location if it was not given.
+func resolveConfigPath(configPath string) string {
+	if len(configPath) != 0 {
+		return configPath
+	}
+
+	return defaultConfigPath()
+}
+
+func rejectPositional(name string, positional []string) {
+	if len(positional) != 0 {
+		exitWithError(configErrorf("%s does not take any arguments, got %s", name, strings.Join(positional, " ")))
+	}
+}
@@ -11,31 +11,33 @@ import (
 type Commit struct {
 	Hash      string
 	Timestamp uint64
+	Parents   []string
 	Root      bool
+	Subject   string
+	// The author or co-author identity which matched config.authors
+	Identity string
+	// Multiplier applied to the commit's counts, less than 1 for co-authored
+	// commits when config.coauthorweight is set
+	Weight float64
 }
 
-func makeCommit(repo *Repo, hash string, timestamp uint64) Commit {
+func makeCommit(hash string, timestamp uint64, parents []string) Commit {
 	return Commit{
 		Hash:      hash,
 		Timestamp: timestamp,
-		Root:      commitIsRoot(repo, hash),
+		Parents:   parents,
+		Root:      len(parents) == 0,
+		Weight:    1,
 	}
 }
 
-func commitIsRoot(repo *Repo, hash string) bool {
-	_, stderr, err := runGitSync(repo.Path, "rev-parse", hash+"^")
-
-	if strings.Contains(stderr, "unknown revision or path not in the working tree") {
-		return true
-	} else if err == nil {
-		return false
-	}
-
-	panic(err.Error())
-}
-
+// Orders commits by timestamp, falling back to the hash so that distinct
+// commits made in the same second are not deduplicated.
 func compareCommit(c1 Commit, c2 Commit) int {
-	return cmp.Compare(c1.Timestamp, c2.Timestamp)
+	return cmp.Or(
+		cmp.Compare(c1.Timestamp, c2.Timestamp),
+		cmp.Compare(c1.Hash, c2.Hash),
+	)
 }
 
 func commitsInsertSortedUnique(commits []Commit, commit Commit) []Commit {
@@ -49,111 +51,378 @@ func commitsInsertSortedUnique(commits []Commit, commit Commit) []Commit {
 }
 
 func getBytesForFileHash(hash string, repo *Repo) (int, error) {
-	stdout, _, err := runGitSync(repo.Path, "cat-file", "-s", hash)
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "cat-file", "-s", hash)
 	if err != nil && strings.Contains(err.Error(), "could not get object info") {
 		return 0, nil
+	} else if err != nil {
+		return 0, err
 	}
-	check(err)
 
 	stdout = strings.ReplaceAll(stdout, "\n", "")
 
 	return strconv.Atoi(stdout)
 }
 
-func iabs(n int) int {
-	if n < 0 {
-		return -n
+// The tree or commit the commit's changes are measured against
+func (commit Commit) diffBase(repo *Repo) string {
+	if commit.Root {
+		return repo.EmptyTree
 	}
 
-	return n
+	return commit.Parents[0]
 }
 
-func (commit Commit) getDiffs(repo *Repo) []Diff {
-	ret := []Diff{}
+// Lines, bytes, and blank lines added and removed for a single file of a
+// patch. For combined diffs of merges only lines added or removed relative to
+// every parent are counted.
+type patchCounts struct {
+	added        LineBytePair
+	removed      LineBytePair
+	addedBlank   int
+	removedBlank int
+}
 
-	var prevCommit string
-	if commit.Root {
-		prevCommit = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
-	} else {
-		prevCommit = "HEAD^"
+func (commit Commit) getDiffs(repo *Repo) ([]Diff, error) {
+	// Merges are only matched when config.merges is first-parent or combined,
+	// first-parent diffs against the first parent like any other commit
+	if len(commit.Parents) > 1 && repo.Config.Merges == "combined" {
+		return commit.getCombinedDiffs(repo)
 	}
 
-	stdout, _, err := runGitSync(repo.Path, "diff", "--patch", prevCommit, commit.Hash)
-	check(err)
+	args := []string{"diff-tree", "-r", "-M"}
 
-	diffLines := strings.Split(stdout, "\n")
+	if repo.Config.Bulk.Whitespace {
+		args = append(args, "-w")
+	}
 
-	var currentDiff Diff
+	base := commit.diffBase(repo)
 
-	minLen := 2
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, append(args, "-z", "--raw", "--numstat", base, commit.Hash)...)
+	if err != nil {
+		return nil, fmt.Errorf("diffing commit %s: %w", commit.Hash, err)
+	}
+
+	diffs := parseRawNumstat(stdout)
 
-	if config.CountSpaces {
-		minLen = 1
+	stdout, _, err = runGitSync(repo.ctx, repo.Path, append(args, "--patch", "--src-prefix=a/", "--dst-prefix=b/", base, commit.Hash)...)
+	if err != nil {
+		return nil, fmt.Errorf("diffing commit %s: %w", commit.Hash, err)
 	}
 
-	for _, line := range diffLines {
-		// Minimum viable line is a +/- followed by any other character
-		if len(line) < minLen {
-			continue
+	patches := parsePatch(stdout)
+
+	ret := []Diff{}
+	for _, diff := range diffs {
+		if diff.Binary {
+			diff.Added.Bytes, err = repo.blobSize(diff.Blob)
+			if err == nil {
+				diff.Removed.Bytes, err = repo.blobSize(diff.OldBlob)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("reading the size of %s in commit %s: %w", diff.File, commit.Hash, err)
+			}
+		} else if counts, ok := patches[diff.File]; ok {
+			diff.Added.Bytes = counts.added.Bytes
+			diff.Removed.Bytes = counts.removed.Bytes
+
+			if !repo.Config.CountSpaces {
+				diff.Added.Lines -= counts.addedBlank
+				diff.Removed.Lines -= counts.removedBlank
+			}
 		}
 
-		if stringBeginsWith(line, "diff") {
-			start := strings.Index(line, "a/")
-			end := strings.Index(line, "b/")
+		ret = append(ret, diff)
+	}
+
+	return ret, nil
+}
+
+func (repo *Repo) blobSize(blob string) (int, error) {
+	if len(strings.Trim(blob, "0")) == 0 {
+		return 0, nil
+	}
+
+	return getBytesForFileHash(blob, repo)
+}
+
+// Parses the NUL delimited output of git diff-tree -z --raw --numstat. Raw
+// entries come first and list every changed path, numstat entries follow with
+// line counts. Paths are matched by name rather than position, as -w leaves
+// whitespace-only changes out of the numstat entries. Mode-only changes,
+// submodules, and paths without line counts are dropped.
+func parseRawNumstat(output string) []Diff {
+	ret := []Diff{}
+	byFile := map[string]int{}
+	counted := map[string]bool{}
+
+	tokens := strings.Split(output, "\x00")
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+
+		if len(token) == 0 {
+			continue
+		}
 
-			if start == -1 || end == -1 {
-				log(Warning, repo, fmt.Sprintf("Patch line contained 'diff', but a/ was at %d and b/ was at %d", start, end))
+		if token[0] == ':' {
+			// :<old mode> <new mode> <old blob> <new blob> <status>
+			fields := strings.Fields(token[1:])
+			if len(fields) != 5 || i+1 >= len(tokens) {
 				continue
 			}
 
-			if len(currentDiff.File) != 0 {
-				ret = append(ret, currentDiff)
+			diff := Diff{
+				OldBlob: fields[2],
+				Blob:    fields[3],
+				Status:  fields[4][0],
 			}
 
-			currentDiff = Diff{
-				File:    line[start+2 : end-1],
-				Added:   LineBytePair{},
-				Removed: LineBytePair{},
+			i++
+			diff.OldFile = tokens[i]
+			diff.File = tokens[i]
+
+			// Renames and copies are followed by both paths
+			if (diff.Status == 'R' || diff.Status == 'C') && i+1 < len(tokens) {
+				i++
+				diff.File = tokens[i]
+				diff.Renamed = diff.Status == 'R'
 			}
 
+			if fields[0] == "160000" || fields[1] == "160000" {
+				continue
+			}
+
+			byFile[diff.File] = len(ret)
+			ret = append(ret, diff)
+			continue
+		}
+
+		// <added> TAB <removed> TAB <path>, or an empty path followed by both
+		// paths for renames and copies
+		fields := strings.SplitN(token, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		file := fields[2]
+		if len(file) == 0 && i+2 < len(tokens) {
+			file = tokens[i+2]
+			i += 2
+		}
+
+		idx, ok := byFile[file]
+		if !ok {
+			continue
+		}
+
+		diff := &ret[idx]
+		counted[file] = true
+
+		if fields[0] == "-" || fields[1] == "-" {
+			diff.Binary = true
+			continue
+		}
+
+		diff.Added.Lines, _ = strconv.Atoi(fields[0])
+		diff.Removed.Lines, _ = strconv.Atoi(fields[1])
+	}
+
+	return slices.DeleteFunc(ret, func(diff Diff) bool {
+		modeOnly := !diff.Renamed && diff.OldBlob == diff.Blob
+		return modeOnly || !counted[diff.File]
+	})
+}
+
+// Parses the path of a ---/+++ patch line, without its a/ or b/ prefix.
+// Returns an empty string for /dev/null.
+func parsePatchPath(value string) string {
+	// Paths containing spaces are terminated with a tab
+	value = strings.TrimSuffix(value, "\t")
+	value = unquoteGitPath(value)
+
+	if value == "/dev/null" {
+		return ""
+	}
+
+	if len(value) > 2 && (value[:2] == "a/" || value[:2] == "b/") {
+		return value[2:]
+	}
+
+	return value
+}
+
+// Parses the line counts of a hunk header, one per parent followed by the
+// count for the result. Regular hunks look like @@ -<start>[,<count>]
+// +<start>[,<count>] @@, combined hunks of merges have an additional @ and
+// range for every extra parent.
+func parseHunkHeader(line string) ([]int, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, false
+	}
+
+	parents := len(fields[0]) - 1
+	if parents < 1 || len(fields) < parents+2 {
+		return nil, false
+	}
+
+	ret := make([]int, parents+1)
+
+	for i, field := range fields[1 : parents+2] {
+		if len(field) < 2 || (field[0] != '-' && field[0] != '+') {
+			return nil, false
+		}
+
+		_, n, found := strings.Cut(field[1:], ",")
+		if !found {
+			ret[i] = 1
 			continue
 		}
 
-		if stringBeginsWith(line, "rename to") {
-			start := len("rename to ")
-			end := len(line)
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, false
+		}
+
+		ret[i] = count
+	}
+
+	return ret, true
+}
+
+// Sums the lines, bytes, and blank lines of every file in a patch, keyed by
+// the new path of the file (or the old path for deletions). Both regular and
+// combined (--cc) patches are supported. Hunks are consumed by the line counts
+// in their headers, so content lines resembling headers are never mistaken for
+// them.
+func parsePatch(patch string) map[string]*patchCounts {
+	ret := map[string]*patchCounts{}
+
+	var current *patchCounts
+	var oldFile string
+	// Lines left in the current hunk for each parent, then the result
+	var left []int
+
+	hunkActive := func() bool {
+		for _, n := range left {
+			if n > 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, line := range strings.Split(patch, "\n") {
+		if hunkActive() {
+			parents := len(left) - 1
 
-			if start == -1 || end == -1 {
-				log(Warning, repo, fmt.Sprintf("Patch line contained 'diff', but a/ was at %d and b/ was at %d", start, end))
+			if stringBeginsWith(line, "\\") {
+				// \ No newline at end of file
 				continue
 			}
 
-			currentDiff.File = line[start:end]
-		}
+			if len(line) < parents {
+				line += strings.Repeat(" ", parents-len(line))
+			}
+
+			// One column per parent, each ' ', '-', or '+'
+			columns := line[:parents]
+			content := line[parents:]
+
+			for i := range parents {
+				if columns[i] != '+' {
+					left[i]--
+				}
+			}
+
+			if !strings.Contains(columns, "-") {
+				left[parents]--
+			}
+
+			switch {
+			case strings.Count(columns, "+") == parents:
+				current.added.Lines++
+				current.added.Bytes += len(content)
+				if len(content) == 0 {
+					current.addedBlank++
+				}
+			case strings.Count(columns, "-") == parents:
+				current.removed.Lines++
+				current.removed.Bytes += len(content)
+				if len(content) == 0 {
+					current.removedBlank++
+				}
+			}
 
-		// Skip lines in either of the following format
-		// --- a/dir/file.ext
-		// +++ b/dir/file.ext
-		if stringBeginsWith(line, "+++") || stringBeginsWith(line, "---") {
 			continue
 		}
 
-		c0 := line[0]
-		c1 := line[1:]
+		switch {
+		case stringBeginsWith(line, "diff --git "), stringBeginsWith(line, "diff --cc "), stringBeginsWith(line, "diff --combined "):
+			current = nil
+			oldFile = ""
+		case stringBeginsWith(line, "--- "):
+			oldFile = parsePatchPath(line[4:])
+		case stringBeginsWith(line, "+++ "):
+			file := parsePatchPath(line[4:])
+			if len(file) == 0 {
+				file = oldFile
+			}
+
+			current = &patchCounts{}
+			ret[file] = current
+		case stringBeginsWith(line, "@@") && current != nil:
+			left, _ = parseHunkHeader(line)
+		}
+	}
+
+	return ret
+}
+
+// Diffs a merge against all of its parents at once, counting only the lines
+// which differ from every parent, i.e. conflict resolutions and changes made
+// during the merge itself.
+func (commit Commit) getCombinedDiffs(repo *Repo) ([]Diff, error) {
+	args := []string{"diff-tree", "-r", "-M", "--cc", "--patch", "--src-prefix=a/", "--dst-prefix=b/"}
+
+	if repo.Config.Bulk.Whitespace {
+		args = append(args, "-w")
+	}
+
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, append(args, commit.Hash)...)
+	if err != nil {
+		return nil, fmt.Errorf("diffing merge %s: %w", commit.Hash, err)
+	}
+
+	ret := []Diff{}
+	for file, counts := range parsePatch(stdout) {
+		diff := Diff{
+			File:    file,
+			OldFile: file,
+			Status:  'M',
+			Added:   counts.added,
+			Removed: counts.removed,
+		}
 
-		switch c0 {
-		case '+':
-			currentDiff.Added.Lines++
-			currentDiff.Added.Bytes += len([]byte(c1))
-		case '-':
-			currentDiff.Removed.Lines++
-			currentDiff.Removed.Bytes += len([]byte(c1))
-		default:
+		if !repo.Config.CountSpaces {
+			diff.Added.Lines -= counts.addedBlank
+			diff.Removed.Lines -= counts.removedBlank
+		}
+
+		if diff.Added.Lines == 0 && diff.Removed.Lines == 0 && diff.Added.Bytes == 0 && diff.Removed.Bytes == 0 {
 			continue
 		}
+
+		ret = append(ret, diff)
 	}
 
-	return append(ret, currentDiff)
+	slices.SortFunc(ret, func(d1 Diff, d2 Diff) int {
+		return cmp.Compare(d1.File, d2.File)
+	})
+
+	return ret, nil
 }
 
 func (commit Commit) shouldSkipCommit() bool {
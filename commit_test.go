@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func runTestGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %s\n%s", args, err, out)
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, file string, data string) {
+	t.Helper()
+
+	fpath := path.Join(dir, file)
+	if err := os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fpath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Builds a repository whose second commit touches files with spaces,
+// non-ASCII characters, and a/ or b/ in their paths, along with a rename, a
+// mode-only change, a whitespace-only change, a binary file, and a deletion.
+func makeDiffFixture(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// Keep the user's config, e.g. core.quotepath, out of the diffs
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	dir := t.TempDir()
+	runTestGit(t, dir, "init", "-q")
+
+	writeTestFile(t, dir, "with space.py", "a\nb\n")
+	writeTestFile(t, dir, "ü.py", "x = 1\ny = 22\n")
+	writeTestFile(t, dir, "rename_me.py", "print('unchanged')\nprint('content')\n")
+	writeTestFile(t, dir, "mode.sh", "echo hi\n")
+	writeTestFile(t, dir, "ws.py", "if x:\n  y\n")
+	writeTestFile(t, dir, "bin.dat", "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09")
+	writeTestFile(t, dir, "a/b/c.py", "p\n")
+	writeTestFile(t, dir, "b/gone.py", "z\n")
+	runTestGit(t, dir, "add", "-A")
+	runTestGit(t, dir, "commit", "-q", "-m", "first")
+
+	writeTestFile(t, dir, "with space.py", "a\nb\nccc\n")
+	writeTestFile(t, dir, "ü.py", "x = 1\n")
+	runTestGit(t, dir, "mv", "rename_me.py", "renamed.py")
+	if err := os.Chmod(path.Join(dir, "mode.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "ws.py", "if x:\n    y\n")
+	writeTestFile(t, dir, "bin.dat", "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14\x15\x16\x17\x18")
+	writeTestFile(t, dir, "a/b/c.py", "p\nq\nrr\n")
+	runTestGit(t, dir, "rm", "-q", "b/gone.py")
+	runTestGit(t, dir, "add", "-A")
+	runTestGit(t, dir, "commit", "-q", "-m", "second")
+
+	return dir
+}
+
+func TestGetDiffs(t *testing.T) {
+	dir := makeDiffFixture(t)
+
+	common := map[string]Diff{
+		"with space.py": {Added: LineBytePair{1, 3}},
+		"ü.py":          {Removed: LineBytePair{1, 6}},
+		"renamed.py":    {OldFile: "rename_me.py", Renamed: true},
+		"bin.dat":       {Added: LineBytePair{0, 25}, Removed: LineBytePair{0, 10}, Binary: true},
+		"a/b/c.py":      {Added: LineBytePair{2, 3}},
+		"b/gone.py":     {Removed: LineBytePair{1, 1}},
+	}
+
+	for _, tt := range []struct {
+		name       string
+		whitespace bool
+		extra      map[string]Diff
+	}{
+		{"whitespace", false, map[string]Diff{"ws.py": {Added: LineBytePair{1, 5}, Removed: LineBytePair{1, 3}}}},
+		{"ignore whitespace", true, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &Repo{
+				Path:   dir,
+				Config: &RepoConfig{CountSpaces: true, Merges: "skip", Bulk: BulkConfig{Whitespace: tt.whitespace}},
+				ctx:    context.Background(),
+			}
+
+			if err := repo.detectObjectFormat(); err != nil {
+				t.Fatal(err)
+			}
+
+			commit, _, err := repo.getCommit("HEAD")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			diffs, err := commit.getDiffs(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]Diff{}
+			for file, diff := range common {
+				want[file] = diff
+			}
+			for file, diff := range tt.extra {
+				want[file] = diff
+			}
+
+			got := map[string]Diff{}
+			for _, diff := range diffs {
+				got[diff.File] = diff
+			}
+
+			// mode.sh only changed its mode, and ws.py only whitespace when
+			// it is ignored
+			for file := range got {
+				if _, ok := want[file]; !ok {
+					t.Errorf("unexpected diff for %q", file)
+				}
+			}
+
+			for file, expected := range want {
+				diff, ok := got[file]
+				if !ok {
+					t.Errorf("missing diff for %q", file)
+					continue
+				}
+
+				if diff.Added != expected.Added || diff.Removed != expected.Removed {
+					t.Errorf("%q: added %+v removed %+v, want added %+v removed %+v", file, diff.Added, diff.Removed, expected.Added, expected.Removed)
+				}
+
+				if diff.Binary != expected.Binary || diff.Renamed != expected.Renamed {
+					t.Errorf("%q: binary %t renamed %t, want binary %t renamed %t", file, diff.Binary, diff.Renamed, expected.Binary, expected.Renamed)
+				}
+
+				if len(expected.OldFile) != 0 && diff.OldFile != expected.OldFile {
+					t.Errorf("%q: old file %q, want %q", file, diff.OldFile, expected.OldFile)
+				}
+			}
+		})
+	}
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path"
+	"reflect"
 	"regexp"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-func checkEmpty[T string | []string](t T, name string) {
+func checkEmpty[T string | []string | []AuthorConfig](t T, name string) error {
 	if len(t) == 0 {
-		panic(fmt.Sprintf("Config is missing field %s!", name))
+		return configErrorf("config is missing field %s", name)
 	}
+
+	return nil
 }
 
 type SVGTheme struct {
@@ -28,9 +39,186 @@ type SVGTheme struct {
 	Percent    string
 }
 
+type IgnoreConfig struct {
+	LinguistVendor bool
+	EnryVendor     bool
+	Dotfiles       bool
+	Configuration  bool
+	Image          bool
+	Test           bool
+	Binary         bool
+	Generated      bool
+	Langs          []string
+}
+
+// Settings applied to a single repository. Every repository starts with the
+// global values from Config, which may then be overridden by an object entry
+// in config.repositories.
+type RepoConfig struct {
+	Name           string
+	Ref            string
+	AllBranches    bool
+	Merges         string
+	Indepth        IndepthMode
+	CountTotal     bool
+	CountSpaces    bool
+	Authors        []AuthorConfig
+	CoAuthors      bool
+	CoAuthorWeight float64
+	Ignore         IgnoreConfig
+	Excludes       []string
+	Languages      map[string]string
+	Weight         float64
+	Since          string
+	Until          string
+	Bulk           BulkConfig
+
+	excludes  []*regexp.Regexp
+	languages []langOverride
+	since     string
+	until     string
+}
+
+type langOverride struct {
+	regex *regexp.Regexp
+	lang  string
+}
+
+// An entry in config.repositories, either a plain "author/repo" string or an
+// object with a name and any overrides from RepoConfig.
+type RepoEntry struct {
+	Name string
+	node *yaml.Node
+}
+
+func (entry *RepoEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		entry.Name = node.Value
+		return nil
+	}
+
+	err := unknownFields(node, reflect.TypeFor[RepoConfig]())
+	if err != nil {
+		return err
+	}
+
+	named := struct{ Name string }{}
+	err = node.Decode(&named)
+	if err != nil {
+		return err
+	}
+
+	entry.Name = named.Name
+	entry.node = node
+
+	return nil
+}
+
+var unmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+
+var unknownFieldRegexp = regexp.MustCompile(`^line (\d+): field (\S+) not found in type .+$`)
+
+// Joins the errors of a yaml.TypeError onto a single line, naming unknown
+// fields plainly rather than by their Go type.
+func yamlErrorString(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		msgs[i] = unknownFieldRegexp.ReplaceAllString(msg, "line $1: unknown field $2")
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Decodes the YAML document in data into out, rejecting keys which match no
+// field. file prefixes any error.
+func decodeStrict(file string, data []byte, out any) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err := dec.Decode(out)
+	if errors.Is(err, io.EOF) {
+		// An empty document
+		return nil
+	} else if err != nil {
+		return configErrorf("%s: %s", file, yamlErrorString(err))
+	}
+
+	return nil
+}
+
+// Reports keys of node which match no field of t, like yaml.Decoder's
+// KnownFields. Node.Decode can not be made strict, so custom unmarshalers
+// check their node with this first. Types with their own UnmarshalYAML are
+// left for it to check.
+func unknownFields(node *yaml.Node, t reflect.Type) error {
+	errs := []string{}
+	collectUnknownFields(node, t, &errs)
+
+	if len(errs) != 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+
+	return nil
+}
+
+func collectUnknownFields(node *yaml.Node, t reflect.Type, errs *[]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch {
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+
+			field, ok := fieldByKey(t, key.Value)
+			if !ok {
+				*errs = append(*errs, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t))
+				continue
+			}
+
+			collectUnknownFields(value, field.Type, errs)
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, item := range node.Content {
+			collectUnknownFields(item, t.Elem(), errs)
+		}
+	}
+}
+
+// The exported field of t decoded from key, which yaml.v3 matches against the
+// lowercased field name.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.IsExported() && strings.ToLower(field.Name) == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
 type Config struct {
+	Include     []string
 	Location    string
-	Indepth     bool
+	State       string
+	History     string
+	Indepth     IndepthMode
+	AllBranches bool
+	Merges      string
 	CountTotal  bool
 	CountSpaces bool
 	LangsCount  int
@@ -41,26 +229,31 @@ type Config struct {
 		BytesBase int
 		ShowTotal bool
 	}
-	Token        string
-	ExcludeForks bool
-	Parallel     uint8
-	Users        []string
-	Orgs         []string
-	Repositories []string
-	Authors      []string
-	Filters      []string
-	Commits      []string
-	Ignore       struct {
-		LinguistVendor bool
-		EnryVendor     bool
-		Dotfiles       bool
-		Configuration  bool
-		Image          bool
-		Test           bool
-		Binary         bool
-		Generated      bool
-		Langs          []string
+	Token          string
+	TokenFile      string
+	TokenCommand   string
+	ExcludeForks   bool
+	Parallel       uint8
+	Users          []string
+	Orgs           []string
+	Repositories   []RepoEntry
+	Authors        []AuthorConfig
+	CoAuthors      bool
+	CoAuthorWeight *float64
+	Filters        []string
+	Commits        []string
+	Excludes       []string
+	Languages      map[string]string
+	Since          string
+	Until          string
+	Bulk           BulkConfig
+	Ignore         IgnoreConfig
+	Timeouts       struct {
+		Git     time.Duration
+		Network time.Duration
+		API     time.Duration
 	}
+	Retries  *int
 	PostExec string
 }
 
@@ -68,36 +261,336 @@ var outputPath string
 var config Config
 var theme SVGTheme
 var reposToCheck []string
+var repoConfigs map[string]*RepoConfig
+
+// SHA-256 of the config file, stored alongside the state it produced
+var configFingerprint string
 
-func initConfig(path string) {
-	data, err := os.ReadFile(path)
-	check(err)
+func compilePattern(pattern string, field string) (*regexp.Regexp, error) {
+	regex, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, configErrorf("pattern \"%s\" in %s failed to compile to regex: %w", pattern, field, err)
+	}
+
+	return regex, nil
+}
+
+var relativeDateRegexp = regexp.MustCompile(`^(\d+)([dwmy])$`)
+
+// Converts a since/until value into a date git log understands. Accepts dates
+// (2006-01-02), RFC 3339 timestamps, and durations relative to now such as
+// 30d, 2w, 6m, or 1y. Plain dates cover the whole day, so an until of
+// 2026-12-31 includes commits made on the 31st.
+func parseDateBound(value string, field string, endOfDay bool) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+
+	const gitFormat = "2006-01-02T15:04:05-07:00"
+
+	if match := relativeDateRegexp.FindStringSubmatch(value); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		now := time.Now()
+
+		switch match[2] {
+		case "d":
+			now = now.AddDate(0, 0, -n)
+		case "w":
+			now = now.AddDate(0, 0, -7*n)
+		case "m":
+			now = now.AddDate(0, -n, 0)
+		case "y":
+			now = now.AddDate(-n, 0, 0)
+		}
+
+		// Truncate to the day so the window only moves once a day
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		return day.Format(gitFormat), nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+
+		return t.Format(gitFormat), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Format(gitFormat), nil
+	}
+
+	return "", configErrorf("config.%s (%s) must be a date (2006-01-02), an RFC 3339 timestamp, or a relative duration such as 30d, 2w, 6m, or 1y", field, value)
+}
+
+// Repository ids become paths below config.location, see repoPath, so
+// anything but author/repo is rejected.
+func checkRepoID(id string) error {
+	author, name, _ := strings.Cut(id, "/")
+
+	if strings.Count(id, "/") != 1 || slices.Contains([]string{"", ".", ".."}, author) || slices.Contains([]string{"", ".", ".."}, name) {
+		return configErrorf("improper repository provided: %s, ensure repositories follow the format author/repo", id)
+	}
+
+	return nil
+}
+
+func makeRepoConfig(entry *RepoEntry) (*RepoConfig, error) {
+	if err := checkRepoID(entry.Name); err != nil {
+		return nil, err
+	}
+
+	rc := &RepoConfig{
+		Name:           entry.Name,
+		Indepth:        config.Indepth,
+		AllBranches:    config.AllBranches,
+		Merges:         config.Merges,
+		CountTotal:     config.CountTotal,
+		CountSpaces:    config.CountSpaces,
+		Authors:        config.Authors,
+		CoAuthors:      config.CoAuthors,
+		CoAuthorWeight: 1,
+		Ignore:         config.Ignore,
+		Excludes:       config.Excludes,
+		Languages:      map[string]string{},
+		Weight:         1,
+		Since:          config.Since,
+		Until:          config.Until,
+		Bulk:           config.Bulk,
+	}
+
+	if config.CoAuthorWeight != nil {
+		rc.CoAuthorWeight = *config.CoAuthorWeight
+	}
+
+	for k, v := range config.Languages {
+		rc.Languages[k] = v
+	}
+
+	if entry.node != nil {
+		err := entry.node.Decode(rc)
+		if err != nil {
+			return nil, configErrorf("config.repositories[%s]: %s", entry.Name, yamlErrorString(err))
+		}
+	}
+
+	if rc.Weight < 0 {
+		return nil, configErrorf("config.repositories[%s].weight must not be negative", rc.Name)
+	}
+
+	if rc.CoAuthorWeight < 0 {
+		return nil, configErrorf("config.repositories[%s].coauthorweight must not be negative", rc.Name)
+	}
+
+	switch rc.Merges {
+	case "":
+		rc.Merges = "skip"
+	case "skip", "first-parent", "combined":
+	default:
+		return nil, configErrorf("config.repositories[%s].merges must be one of skip, first-parent, or combined", rc.Name)
+	}
+
+	err := rc.Bulk.compile(rc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.since, err = parseDateBound(rc.Since, "since", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.until, err = parseDateBound(rc.Until, "until", true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range rc.Excludes {
+		regex, err := compilePattern(pattern, "excludes")
+		if err != nil {
+			return nil, err
+		}
+
+		rc.excludes = append(rc.excludes, regex)
+	}
+
+	patterns := make([]string, 0, len(rc.Languages))
+	for pattern := range rc.Languages {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		regex, err := compilePattern(pattern, "languages")
+		if err != nil {
+			return nil, err
+		}
+
+		rc.languages = append(rc.languages, langOverride{
+			regex: regex,
+			lang:  rc.Languages[pattern],
+		})
+	}
+
+	return rc, nil
+}
+
+// Relative theme paths are resolved against the directory of the config, so
+// a config kept elsewhere can sit next to its theme, falling back to the
+// working directory.
+func resolveThemePath(configPath string, theme string) (string, bool) {
+	if !path.IsAbs(theme) {
+		if nextTo := path.Join(path.Dir(configPath), theme); fileExists(nextTo) {
+			return nextTo, true
+		}
+	}
+
+	return theme, fileExists(theme)
+}
+
+// Resolves a path given in the config against the directory of the config,
+// expanding a leading ~/ to the home directory.
+func resolveConfigRelative(configPath string, file string) (string, error) {
+	if rest, ok := strings.CutPrefix(file, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", &ConfigError{Err: err}
+		}
+
+		return path.Join(home, rest), nil
+	}
+
+	if path.IsAbs(file) {
+		return file, nil
+	}
+
+	return path.Join(path.Dir(configPath), file), nil
+}
+
+// Fills in config.token from config.tokenfile or the output of
+// config.tokencommand, falling back to the GITHUB_TOKEN environment variable
+// when none of them are set. Only called when the token is needed, so that
+// commands which never talk to GitHub do not run config.tokencommand.
+func resolveToken() error {
+	switch {
+	case len(config.Token) != 0:
+	case len(config.TokenFile) != 0:
+		data, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			return configErrorf("reading config.tokenfile: %w", err)
+		}
+
+		config.Token = strings.TrimSpace(string(data))
+		if len(config.Token) == 0 {
+			return configErrorf("config.tokenfile (%s) is empty", config.TokenFile)
+		}
+	case len(config.TokenCommand) != 0:
+		logEcho(Info, nil, fmt.Sprintf("Running TokenCommand '%s'", config.TokenCommand), true)
+
+		// Password managers may prompt for a passphrase
+		cmd := exec.Command("sh", "-c", config.TokenCommand)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return configErrorf("running config.tokencommand: %w", err)
+		}
+
+		config.Token = strings.TrimSpace(string(out))
+		if len(config.Token) == 0 {
+			return configErrorf("config.tokencommand printed nothing")
+		}
+	default:
+		config.Token = os.Getenv("GITHUB_TOKEN")
+	}
+
+	return nil
+}
+
+// Reads and validates the config without looking up any repositories, for
+// commands which do not need them.
+func loadConfig(configPath string) error {
+	root, err := readConfigFile(configPath, nil)
+	if err != nil {
+		return err
+	}
 
 	config = Config{}
-	err = yaml.Unmarshal(data, &config)
-	check(err)
+	err = root.Decode(&config)
+	if err != nil {
+		return configErrorf("%s: %s", configPath, yamlErrorString(err))
+	}
+
+	// Covers included files and expanded variables as well
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return &ConfigError{Err: err}
+	}
+
+	configFingerprint = fmt.Sprintf("%x", sha256.Sum256(data))
+
+	for _, err := range []error{
+		checkEmpty(config.Location, "location"),
+		// checkEmpty(config.Repositories, "repositories"),
+		checkEmpty(config.Authors, "authors"),
+		checkEmpty(config.Style.Type, "style.type"),
+		checkEmpty(config.Style.Count, "style.count"),
+		checkEmpty(config.Style.Theme, "style.theme"),
+		// checkEmpty(config.Token, "token"),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	sources := 0
+	for _, source := range []string{config.Token, config.TokenFile, config.TokenCommand} {
+		if len(source) != 0 {
+			sources++
+		}
+	}
 
-	checkEmpty(config.Location, "location")
-	// check_empty(config.Repositories, "repositories")
-	checkEmpty(config.Authors, "authors")
-	checkEmpty(config.Style.Type, "style.type")
-	checkEmpty(config.Style.Count, "style.count")
-	checkEmpty(config.Style.Theme, "style.theme")
-	// check_empty(config.Token, "token")
+	if sources > 1 {
+		return configErrorf("only one of config.token, config.tokenfile, and config.tokencommand may be set")
+	}
+
+	if len(config.TokenFile) != 0 {
+		config.TokenFile, err = resolveConfigRelative(configPath, config.TokenFile)
+		if err != nil {
+			return err
+		}
+	}
 
-	if !fileExists(config.Style.Theme) {
-		panic(fmt.Sprintf("config.style.theme (%s) does not exist on disk!", config.Style.Theme))
+	themePath, ok := resolveThemePath(configPath, config.Style.Theme)
+	if !ok {
+		return configErrorf("config.style.theme (%s) does not exist next to %s or in the working directory", config.Style.Theme, configPath)
 	}
 
+	config.Style.Theme = themePath
+
 	data, err = os.ReadFile(config.Style.Theme)
-	check(err)
+	if err != nil {
+		return &ConfigError{Err: err}
+	}
 
 	theme = SVGTheme{}
-	err = yaml.Unmarshal(data, &theme)
-	check(err)
+	err = decodeStrict(config.Style.Theme, data, &theme)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains([]string{"compact", "vertical"}, strings.ToLower(config.Style.Type)) {
+		return configErrorf("config.style.type must be either compact or vertical, not %s", config.Style.Type)
+	}
+
+	if config.Style.Count != "lines" && config.Style.Count != "bytes" {
+		return configErrorf("config.style.count must be either lines or bytes, not %s", config.Style.Count)
+	}
 
 	if config.Style.Count == "bytes" && config.Style.BytesBase != 1000 && config.Style.BytesBase != 1024 {
-		panic("config.style.bytesbase must be either 1000 or 1024!")
+		return configErrorf("config.style.bytesbase must be either 1000 or 1024")
 	}
 
 	if config.Parallel == 0 {
@@ -108,24 +601,120 @@ func initConfig(path string) {
 		config.LangsCount = 5
 	}
 
-	err = os.MkdirAll(config.Location, os.FileMode(0777))
-	check(err)
+	if config.Timeouts.Git == 0 {
+		config.Timeouts.Git = 10 * time.Minute
+	}
 
-	reposToCheck = config.Repositories
+	if config.Timeouts.Network == 0 {
+		config.Timeouts.Network = 30 * time.Minute
+	}
 
-	var testRepo func(repo string) (bool, string)
+	if config.Timeouts.API == 0 {
+		config.Timeouts.API = 30 * time.Second
+	}
 
-	if len(config.Filters) > 0 {
-		filters := []*regexp.Regexp{}
+	if config.Timeouts.Git < 0 || config.Timeouts.Network < 0 || config.Timeouts.API < 0 {
+		return configErrorf("config.timeouts must not be negative")
+	}
 
-		for _, pattern := range config.Filters {
-			regex, err := regexp.Compile(pattern)
+	if config.Retries == nil {
+		retries := 3
+		config.Retries = &retries
+	} else if *config.Retries < 0 {
+		return configErrorf("config.retries must not be negative")
+	}
 
-			if err != nil {
-				panic(fmt.Sprintf("Pattern \"%s\" failed to compile to regex: error %s", pattern, err.Error()))
-			}
+	if len(config.State) == 0 {
+		config.State = path.Join(config.Location, "state.gob")
+	}
+
+	return nil
+}
+
+// Creates config.location and the directories of config.state and
+// config.history. loadConfig only reads, so that commands which never write,
+// such as validate, leave the filesystem untouched.
+func createDirs() error {
+	err := os.MkdirAll(config.Location, os.FileMode(0777))
+	if err != nil {
+		return fmt.Errorf("creating config.location: %w", err)
+	}
+
+	err = os.MkdirAll(path.Dir(config.State), os.FileMode(0777))
+	if err != nil {
+		return fmt.Errorf("creating the directory of config.state: %w", err)
+	}
+
+	if len(config.History) != 0 {
+		err = os.MkdirAll(path.Dir(config.History), os.FileMode(0777))
+		if err != nil {
+			return fmt.Errorf("creating the directory of config.history: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Builds the settings of each repository in config.repositories, without
+// fetching the repositories of config.users or config.orgs.
+func initRepoConfigs() error {
+	reposToCheck = []string{}
+	repoConfigs = map[string]*RepoConfig{}
+
+	for i := range config.Repositories {
+		entry := &config.Repositories[i]
+		err := checkEmpty(entry.Name, "repositories.name")
+		if err != nil {
+			return err
+		}
+
+		if _, ok := repoConfigs[entry.Name]; ok {
+			return configErrorf("repository %s is listed more than once in config.repositories", entry.Name)
+		}
+
+		rc, err := makeRepoConfig(entry)
+		if err != nil {
+			return err
+		}
 
-			filters = append(filters, regex)
+		reposToCheck = append(reposToCheck, entry.Name)
+		repoConfigs[entry.Name] = rc
+	}
+
+	return nil
+}
+
+func compileFilters() ([]*regexp.Regexp, error) {
+	filters := []*regexp.Regexp{}
+
+	for _, pattern := range config.Filters {
+		regex, err := compilePattern(pattern, "filters")
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, regex)
+	}
+
+	return filters, nil
+}
+
+func initConfig(configPath string) error {
+	err := loadConfig(configPath)
+	if err == nil {
+		err = initRepoConfigs()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var testRepo func(repo string) (bool, string)
+
+	if len(config.Filters) > 0 {
+		filters, err := compileFilters()
+		if err != nil {
+			return err
 		}
 
 		testRepo = func(repo string) (bool, string) {
@@ -141,7 +730,7 @@ func initConfig(path string) {
 		testRepo = func(_ string) (bool, string) { return false, "" }
 	}
 
-	copyToReposToCheck := func(repoResponses []RepoResponse) {
+	copyToReposToCheck := func(repoResponses []RepoResponse) error {
 		for _, repo := range repoResponses {
 			if slices.Contains(reposToCheck, repo.Full_Name) {
 				continue
@@ -157,25 +746,58 @@ func initConfig(path string) {
 				continue
 			}
 
+			rc, err := makeRepoConfig(&RepoEntry{Name: repo.Full_Name})
+			if err != nil {
+				return err
+			}
+
 			reposToCheck = append(reposToCheck, repo.Full_Name)
+			repoConfigs[repo.Full_Name] = rc
+		}
+
+		return nil
+	}
+
+	if len(config.Users) != 0 || len(config.Orgs) != 0 {
+		err := resolveToken()
+		if err != nil {
+			return err
 		}
 	}
 
 	for _, user := range config.Users {
 		logEcho(Info, nil, fmt.Sprintf("Fetching repositories for user %s", user), true)
-		copyToReposToCheck(githubGetAccountRepos(user, false, config.Token))
+
+		repos, err := githubGetAccountRepos(user, false, config.Token)
+		if err == nil {
+			err = copyToReposToCheck(repos)
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, org := range config.Orgs {
 		logEcho(Info, nil, fmt.Sprintf("Fetching repositories for org %s", org), true)
-		copyToReposToCheck(githubGetAccountRepos(org, true, config.Token))
+
+		repos, err := githubGetAccountRepos(org, true, config.Token)
+		if err == nil {
+			err = copyToReposToCheck(repos)
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(reposToCheck) == 0 {
-		panic("There are no repositorites to check! Either all have been filtered or none were provided. See config.users, config.orgs, and config.repositorites")
+		return configErrorf("there are no repositories to check, either all have been filtered or none were provided. See config.users, config.orgs, and config.repositories")
 	}
 
 	sort.Slice(reposToCheck, func(i, j int) bool {
 		return strings.ToLower(reposToCheck[i]) < strings.ToLower(reposToCheck[j])
 	})
+
+	return nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ${NAME} or ${NAME:-default}, with $${ escaping a literal ${
+var envRegexp = regexp.MustCompile(`\$(\$)?\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Reads a config file along with the files it includes, returning the merged
+// mapping. Each file is checked on its own, so that errors name the file and
+// line they are on. chain holds the files including this one.
+func readConfigFile(file string, chain []string) (*yaml.Node, error) {
+	file = path.Clean(file)
+	if slices.Contains(chain, file) {
+		return nil, configErrorf("%s includes itself through %s", file, strings.Join(append(chain, file), " -> "))
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+
+	doc := yaml.Node{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, configErrorf("%s: %s", file, yamlErrorString(err))
+	}
+
+	// An empty file sets nothing
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(doc.Content) != 0 {
+		root = doc.Content[0]
+	}
+
+	if root.Kind != yaml.MappingNode {
+		return nil, configErrorf("%s: line %d: expected a mapping of options", file, root.Line)
+	}
+
+	err = expandEnv(root)
+	if err == nil {
+		err = unknownFields(root, reflect.TypeFor[Config]())
+	}
+
+	parsed := Config{}
+	if err == nil {
+		err = root.Decode(&parsed)
+	}
+
+	if err != nil {
+		return nil, configErrorf("%s: %s", file, yamlErrorString(err))
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+
+	for _, include := range parsed.Include {
+		if !path.IsAbs(include) {
+			include = path.Join(path.Dir(file), include)
+		}
+
+		node, err := readConfigFile(include, append(chain, file))
+		if err != nil {
+			return nil, err
+		}
+
+		mergeNodes(merged, node)
+	}
+
+	mergeNodes(merged, root)
+	return merged, nil
+}
+
+// Merges the mapping src into dst. Nested mappings are merged key by key,
+// any other value of src, lists included, replaces the one in dst.
+func mergeNodes(dst *yaml.Node, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		idx := -1
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				idx = j + 1
+				break
+			}
+		}
+
+		if idx == -1 {
+			dst.Content = append(dst.Content, key, value)
+			continue
+		}
+
+		// Merged into a new node, leaving both sources untouched
+		if existing := dst.Content[idx]; existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: value.Line, Column: value.Column}
+			mergeNodes(merged, existing)
+			mergeNodes(merged, value)
+			value = merged
+		}
+
+		dst.Content[idx] = value
+	}
+}
+
+// Expands environment variables in the string values below node. Keys are
+// left alone. Unset variables without a default are an error, rather than
+// silently expanding to nothing.
+func expandEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" || !strings.Contains(node.Value, "${") {
+			return nil
+		}
+
+		missing := []string{}
+		node.Value = envRegexp.ReplaceAllStringFunc(node.Value, func(match string) string {
+			groups := envRegexp.FindStringSubmatch(match)
+			if len(groups[1]) != 0 {
+				return match[1:]
+			}
+
+			// Like sh, the default also replaces an empty value
+			value, ok := os.LookupEnv(groups[2])
+			if len(groups[3]) != 0 && len(value) == 0 {
+				return groups[4]
+			} else if !ok {
+				missing = append(missing, groups[2])
+			}
+
+			return value
+		})
+
+		if len(missing) != 0 {
+			return fmt.Errorf("line %d: environment variable %s is not set", node.Line, strings.Join(missing, ", "))
+		}
+
+		// Unquoted values are resolved again, so that e.g. ${PARALLEL} may
+		// expand to a number
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnv(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := expandEnv(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -3,11 +3,21 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"os"
+	"path"
+	"slices"
 	"sync"
+	"time"
 )
 
-const SAVEFILE = "./state.gob"
+// Where state was stored before config.state existed, still read if
+// config.state does not exist yet
+const LEGACYSAVEFILE = "./state.gob"
+
+// Identifies state files, and the version of the body which follows the header
+const STATEMAGIC = "ppebtrics state"
+const STATEVERSION = 1
 
 type ConcData struct {
 	mu    sync.Mutex
@@ -15,24 +25,171 @@ type ConcData struct {
 	l     map[string][]LineBytePairForLang
 	f     int
 	repos []Repo
+	// Repositories whose count was interrupted
+	partial []Repo
+	// Repositories whose count failed
+	failures []RepoFailure
+}
+
+type RepoFailure struct {
+	Identifier string
+	Err        error
+	// The state of the last complete run, counted in place of the repository
+	Cached *SerializedRepo
+}
+
+// Adds the counts of a repository to the totals, the caller must hold d.mu.
+func (d *ConcData) addCounts(repo *Repo, counts map[string]*LineBytePair, files int) {
+	for k, v := range counts {
+		if slices.Contains(repo.Config.Ignore.Langs, k) {
+			continue
+		}
+
+		lines := weigh(v.Lines, repo.Config.Weight)
+		bytes := weigh(v.Bytes, repo.Config.Weight)
+
+		if d.v[k] == nil {
+			d.v[k] = &LineBytePair{}
+		}
+
+		d.v[k].Lines += lines
+		d.v[k].Bytes += bytes
+
+		if d.l[k] == nil {
+			d.l[k] = []LineBytePairForLang{}
+		}
+
+		d.l[k] = append(d.l[k], LineBytePairForLang{
+			lang:  repo.Identifier,
+			lines: lines,
+			bytes: bytes,
+		})
+	}
+
+	d.f += files
 }
 
 type SerializedRepo struct {
+	// sha1 or sha256, hashes are stored in full
+	ObjectFormat string
+	// config.merges mode the commit counts were computed with
+	Merges          string
 	CommitHashes    []string
 	CommitCounts    map[string]*LineBytePair
 	LangCounts      map[string]*LineBytePair
 	UniqueFileCount int
+	// Lines and bytes owned by the configured authors, keyed by
+	// "<blob hash> <path>"
+	BlameCache map[string]LineBytePair
+	// Per-commit results keyed by commit hash
+	CommitCache map[string]*CommitResult
+	// Tree hash of the latest snapshot count, and the classification of each
+	// file in it keyed by "<blob hash> <path>"
+	SnapshotTree  string
+	SnapshotCache map[string]SnapshotFile
+	// Hashes of the settings the cached results were computed with
+	Fingerprint map[string]string
+	// Latest commit of the checked out ref, and when it was analyzed
+	Head     string
+	Analyzed time.Time
 }
 
 // Serialized state
 type State struct {
+	Version int
+	// Fingerprint of the config the state was written with
+	Fingerprint string
+	Repos       map[string]SerializedRepo
+}
+
+// State files are a stateHeader followed by the body for its version, both
+// gob encoded. Files written before versioning are a bare stateBodyV0.
+type stateHeader struct {
+	Magic       string
+	Version     int
+	Fingerprint string
+}
+
+type stateBodyV0 struct {
 	Repos map[string]SerializedRepo
 }
 
-func (s *State) toGOB64() ([]byte, error) {
+type stateBodyV1 struct {
+	Repos map[string]SerializedRepo
+}
+
+// Upgrades the state from the version at the index to the next version
+var stateMigrations = []func(s *State){
+	// 0 -> 1: The merges option did not exist and hashes were abbreviated.
+	// Abbreviated hashes will not match, so in-depth repositories are
+	// recounted on the first run.
+	func(s *State) {
+		for id, repo := range s.Repos {
+			if len(repo.Merges) == 0 {
+				repo.Merges = "skip"
+			}
+
+			if len(repo.ObjectFormat) == 0 {
+				repo.ObjectFormat = "sha1"
+			}
+
+			s.Repos[id] = repo
+		}
+	},
+}
+
+func (s *State) decode(by []byte) error {
+	header := stateHeader{}
+	dec := gob.NewDecoder(bytes.NewReader(by))
+
+	if err := dec.Decode(&header); err != nil || header.Magic != STATEMAGIC {
+		// Unversioned state, written before the header existed
+		body := stateBodyV0{}
+		if err := gob.NewDecoder(bytes.NewReader(by)).Decode(&body); err != nil {
+			return fmt.Errorf("state is neither versioned nor legacy state: %w", err)
+		}
+
+		s.Version = 0
+		s.Repos = body.Repos
+		return nil
+	}
+
+	if header.Version > STATEVERSION {
+		return fmt.Errorf("state version %d is newer than the supported version %d", header.Version, STATEVERSION)
+	}
+
+	s.Version = header.Version
+	s.Fingerprint = header.Fingerprint
+
+	switch header.Version {
+	case 1:
+		body := stateBodyV1{}
+		if err := dec.Decode(&body); err != nil {
+			return fmt.Errorf("failed to decode version %d state: %w", header.Version, err)
+		}
+
+		s.Repos = body.Repos
+	default:
+		return fmt.Errorf("unknown state version %d", header.Version)
+	}
+
+	return nil
+}
+
+func (s *State) encode() ([]byte, error) {
 	b := bytes.Buffer{}
 	e := gob.NewEncoder(&b)
-	err := e.Encode(s)
+
+	err := e.Encode(stateHeader{
+		Magic:       STATEMAGIC,
+		Version:     STATEVERSION,
+		Fingerprint: s.Fingerprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.Encode(stateBodyV1{Repos: s.Repos})
 	if err != nil {
 		return nil, err
 	}
@@ -40,51 +197,123 @@ func (s *State) toGOB64() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func stateFromGOB64(s *State, by []byte) error {
-	buf := bytes.Buffer{}
-	buf.Write(by)
+// Reads the state from config.state, or the legacy ./state.gob if it does not
+// exist, migrating it to the current version. Returns an error satisfying
+// os.IsNotExist if there is no state yet.
+func (s *State) read() error {
+	statePath := config.State
 
-	dec := gob.NewDecoder(&buf)
-	err := dec.Decode(&s)
+	if !fileExists(statePath) && fileExists(LEGACYSAVEFILE) {
+		log(Info, nil, fmt.Sprintf("Reading legacy state from %s, it will be written to %s", LEGACYSAVEFILE, statePath))
+		statePath = LEGACYSAVEFILE
+	}
+
+	by, err := os.ReadFile(statePath)
+	if err != nil {
+		return err
+	}
 
-	return err
+	err = s.decode(by)
+	if err != nil {
+		return fmt.Errorf("%s: %w", statePath, err)
+	}
+
+	for s.Version < STATEVERSION {
+		log(Info, nil, fmt.Sprintf("Migrating state from version %d to %d", s.Version, s.Version+1))
+		stateMigrations[s.Version](s)
+		s.Version++
+	}
+
+	if s.Repos == nil {
+		s.Repos = map[string]SerializedRepo{}
+	}
+
+	if len(s.Fingerprint) != 0 && s.Fingerprint != configFingerprint {
+		log(Info, nil, "The config has changed since the state was written")
+	}
+
+	return nil
 }
 
-func (s *State) read() error {
-	gob.Register(State{})
+// Writes the state to a temporary file beside config.state, then renames it
+// into place so an interrupted write never leaves a corrupt state behind.
+func (s *State) write() error {
+	by, err := s.encode()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(path.Dir(config.State), ".state-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-	_, err := os.Stat(SAVEFILE)
+	_, err = tmp.Write(by)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 
-	if err != nil || os.IsNotExist(err) {
+	if err != nil {
 		return err
 	}
 
-	by, err := os.ReadFile(SAVEFILE)
+	err = os.Chmod(tmp.Name(), 0644)
 	if err != nil {
 		return err
 	}
 
-	err = stateFromGOB64(s, by)
-	return err
+	return os.Rename(tmp.Name(), config.State)
 }
 
-func (d *ConcData) writeState() error {
-	s := State{}
-	s.Repos = map[string]SerializedRepo{}
+// Writes the state of the repositories counted. Configured repositories which
+// were not counted, e.g. because the run was interrupted, keep their state
+// from old.
+func (d *ConcData) writeState(old *State) error {
+	s := State{
+		Version:     STATEVERSION,
+		Fingerprint: configFingerprint,
+		Repos:       map[string]SerializedRepo{},
+	}
+
+	now := time.Now()
 
 	for _, repo := range d.repos {
 		s.Repos[repo.Identifier] = SerializedRepo{
+			ObjectFormat:    repo.ObjectFormat,
+			Merges:          repo.Config.Merges,
 			CommitHashes:    repo.CommitHashesOrdered,
 			CommitCounts:    repo.CommitCounts,
 			LangCounts:      repo.LangCounts,
 			UniqueFileCount: repo.UniqueFileCount,
+			BlameCache:      repo.BlameCache,
+			CommitCache:     repo.CommitCache,
+			SnapshotTree:    repo.SnapshotTree,
+			SnapshotCache:   repo.SnapshotCache,
+			Fingerprint:     repo.Fingerprint,
+			Head:            repo.LatestCommit.Hash,
+			Analyzed:        now,
 		}
 	}
 
-	by, err := s.toGOB64()
-	if err != nil {
-		return err
+	for _, repo := range d.partial {
+		// Interrupted before its settings were compared
+		if repo.Fingerprint == nil {
+			continue
+		}
+
+		s.Repos[repo.Identifier] = repo.partialState()
+	}
+
+	for id, repo := range old.Repos {
+		if _, ok := s.Repos[id]; !ok && slices.Contains(reposToCheck, id) {
+			s.Repos[id] = repo
+		}
 	}
 
-	return os.WriteFile(SAVEFILE, by, 0644)
+	return s.write()
 }
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path"
-
-	"github.com/go-enry/go-enry/v2"
 )
 
 type LineBytePair struct {
@@ -15,13 +13,20 @@ type LineBytePair struct {
 
 type Diff struct {
 	File    string
+	OldFile string
+	Blob    string
+	OldBlob string
+	// A, C, D, M, R, T, U, or X, see --diff-filter in git-diff(1)
+	Status  byte
 	Added   LineBytePair
 	Removed LineBytePair
+	Renamed bool
+	Binary  bool
 }
 
-func (diff Diff) shouldSkip(repo *Repo) bool {
+func (diff Diff) shouldSkip(repo *Repo) (bool, error) {
 	if stored, ok := repo.FileSkipMap[diff.File]; ok {
-		return stored
+		return stored, nil
 	}
 
 	ret := false
@@ -29,18 +34,32 @@ func (diff Diff) shouldSkip(repo *Repo) bool {
 	fpath := path.Join(repo.Path, diff.File)
 
 	fe := fileExists(fpath)
-	sy := fe && isSymlink(fpath)
-	di := fe && isDirectory(fpath)
+	sy := false
+	di := false
+
+	if fe {
+		var err error
+		if sy, err = isSymlink(fpath); err == nil {
+			di, err = isDirectory(fpath)
+		}
+
+		if err != nil {
+			return false, err
+		}
+	}
+
 	if !fe || sy || di {
 		log(Info, repo, fmt.Sprintf("Skipping path %s, exists: %t, symlink: %t, dir: %t", fpath, fe, sy, di))
 		// If the file doesn't exist, keep checking because sometimes it shows
 		// up later?? May have to do with renames...
-		return true
+		return true, nil
 	} else if repo.shouldSkipFileByName(diff.File) {
 		ret = true
 	} else {
 		data, err := os.ReadFile(fpath)
-		check(err)
+		if err != nil {
+			return false, err
+		}
 
 		if repo.skipFileByData(diff.File, data) {
 			ret = true
@@ -48,21 +67,23 @@ func (diff Diff) shouldSkip(repo *Repo) bool {
 	}
 
 	repo.FileSkipMap[diff.File] = ret
-	return ret
+	return ret, nil
 }
 
-func (diff Diff) getLanguages(repo *Repo) []string {
+func (diff Diff) getLanguages(repo *Repo) ([]string, error) {
 	if stored, ok := repo.FileLangMap[diff.File]; ok {
-		return stored
+		return stored, nil
 	}
 
 	fpath := path.Join(repo.Path, diff.File)
 
 	data, err := os.ReadFile(fpath)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
-	langs := enry.GetLanguages(diff.File, data)
+	langs := repo.getLanguages(diff.File, data)
 	repo.FileLangMap[diff.File] = langs
 
-	return langs
+	return langs, nil
 }
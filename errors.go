@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Exit codes, so that scripts can tell what went wrong
+const (
+	ExitAnalysis    = 1
+	ExitConfig      = 2
+	ExitNetwork     = 3
+	ExitInterrupted = 130
+)
+
+// A mistake in config.yml or the theme, or a bad command line
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+func configErrorf(format string, args ...any) error {
+	return &ConfigError{Err: fmt.Errorf(format, args...)}
+}
+
+// A failure talking to GitHub, including cloning and fetching
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string { return e.Err.Error() }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+func networkErrorf(format string, args ...any) error {
+	return &NetworkError{Err: fmt.Errorf(format, args...)}
+}
+
+func exitCode(err error) int {
+	var configErr *ConfigError
+	var networkErr *NetworkError
+
+	switch {
+	case errors.As(err, &configErr):
+		return ExitConfig
+	case errors.As(err, &networkErr):
+		return ExitNetwork
+	default:
+		return ExitAnalysis
+	}
+}
+
+// Prints err without a stack trace and exits with the code for its kind,
+// restoring the terminal and releasing the lock if it is held.
+func exitWithError(err error) {
+	logResetTermIfNeeded()
+	logEcho(Critical, nil, err.Error(), false)
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+
+	if lockHeld.Load() {
+		if err := unlock(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove lockfile: %s\n", err)
+		}
+	}
+
+	os.Exit(exitCode(err))
+}
+
+// A failure which may go away if the operation is retried, such as a dropped
+// connection or a timeout
+type TransientError struct {
+	Err error
+	// How long the server asked to wait before retrying, if it did
+	Wait time.Duration
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+func (e *TransientError) Unwrap() error { return e.Err }
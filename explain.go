@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-enry/go-enry/v2"
+)
+
+func explainMain(args []string) {
+	fs := newFlagSet("explain", `
+Show how the files of a repository were classified: which ignore rules and
+linguist-vendored patterns match, the language candidates, and what is counted.
+Given a commit, shows whether it is counted and what each file it changes
+contributes. Uses the existing clone, without fetching or checking out.
+
+Usage: ./ppebtrics explain [OPTIONS] <repo> [path|commit]
+  <repo>               Repository in the format author/repo
+  [path]               File or directory of the checked out tree, defaults to
+                       every file
+  [commit]             Commit to explain, as counted with indepth: true
+
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+`)
+
+	configPath := configFlag(fs)
+	positional := parseFlags(fs, args)
+
+	if len(positional) == 0 || len(positional) > 2 {
+		exitWithError(configErrorf("explain takes a repository and optionally a path or commit, see ./ppebtrics explain --help"))
+	}
+
+	// Only the log file, the explanation itself is written to stdout
+	err := initLog(true)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	defer logClose()
+
+	err = loadConfig(resolveConfigPath(*configPath))
+	if err == nil {
+		err = initRepoConfigs()
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	repo, err := openClone(positional[0])
+	if err != nil {
+		exitWithError(err)
+	}
+
+	target := ""
+	if len(positional) == 2 {
+		target = positional[1]
+	}
+
+	err = repo.explain(os.Stdout, target)
+	if err != nil {
+		exitWithError(err)
+	}
+}
+
+// Prepares an existing clone for reading. The repository does not have to be
+// configured, in which case the defaults of config.repositories apply.
+func openClone(id string) (*Repo, error) {
+	rc, ok := repoConfigs[id]
+	if !ok {
+		var err error
+		rc, err = makeRepoConfig(&RepoEntry{Name: id})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	repo := &Repo{
+		Identifier: id,
+		Config:     rc,
+		Path:       repoPath(id),
+		LogID:      -1,
+		ctx:        context.Background(),
+	}
+
+	if !fileExists(repo.Path) {
+		return nil, fmt.Errorf("%s has not been cloned to %s yet, run ./ppebtrics run first", id, repo.Path)
+	}
+
+	err := repo.detectObjectFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.VendoredFilters = repo.vendoredFilters()
+	return repo, nil
+}
+
+// How a single file is classified, see Repo.explainFile
+type fileExplanation struct {
+	rules    []ruleResult
+	override *langOverride
+	// Languages detected by enry, ignoring config.languages
+	candidates []string
+	lang       string
+	lines      int
+	bytes      int
+}
+
+type ruleResult struct {
+	rule    fileRule
+	matched bool
+	pattern string
+}
+
+// The option of the first enabled rule matching the file, or an empty string
+// if the file is counted.
+func (e *fileExplanation) skippedBy() string {
+	for _, result := range e.rules {
+		if result.matched && result.rule.enabled {
+			return result.rule.option
+		}
+	}
+
+	return ""
+}
+
+// Classifies a file the same way counting does, but evaluates every rule
+// rather than stopping at the first match.
+func (repo *Repo) explainFile(file string, data []byte) *fileExplanation {
+	ret := &fileExplanation{
+		candidates: enry.GetLanguages(file, data),
+		lines:      bytes.Count(data, []byte{'\n'}),
+		bytes:      len(data),
+	}
+
+	for _, rule := range append(repo.nameRules(), repo.dataRules()...) {
+		matched, pattern := rule.match(file, data)
+		ret.rules = append(ret.rules, ruleResult{rule, matched, pattern})
+	}
+
+	if override, ok := repo.languageOverride(file); ok {
+		ret.override = &override
+		ret.lang = override.lang
+	} else if len(ret.candidates) != 0 {
+		ret.lang = ret.candidates[0]
+	} else {
+		ret.lang = "Unknown"
+	}
+
+	return ret
+}
+
+func (e *fileExplanation) print(w io.Writer, file string, result string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\n", file)
+
+	for _, result := range e.rules {
+		state := "off"
+		if result.rule.enabled {
+			state = "on"
+		}
+
+		match := "no match"
+		if result.matched && len(result.pattern) != 0 {
+			match = "matched " + result.pattern
+		} else if result.matched {
+			match = "matched"
+		}
+
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", result.rule.option, state, match)
+	}
+
+	if e.override != nil {
+		fmt.Fprintf(tw, "  languages\t\t%s, matched %s\n", e.override.lang, e.override.regex.String())
+	} else {
+		fmt.Fprintf(tw, "  languages\t\tno override\n")
+	}
+
+	candidates := "none"
+	if len(e.candidates) != 0 {
+		candidates = strings.Join(e.candidates, ", ")
+	}
+
+	fmt.Fprintf(tw, "  candidates\t\t%s\n", candidates)
+	fmt.Fprintf(tw, "  result\t\t%s\n", result)
+	tw.Flush()
+
+	fmt.Fprintln(w)
+}
+
+// Explains the files of the checked out tree under target, or the commit
+// target names if it is not a path.
+func (repo *Repo) explain(w io.Writer, target string) error {
+	entries, err := repo.getTreeEntries()
+	if err != nil {
+		return err
+	}
+
+	dir := strings.TrimSuffix(target, "/") + "/"
+	matched := []treeEntry{}
+
+	for _, entry := range entries {
+		if len(target) == 0 || entry.File == target || strings.HasPrefix(entry.File, dir) {
+			matched = append(matched, entry)
+		}
+	}
+
+	if len(target) == 0 || len(matched) != 0 {
+		return repo.explainTree(w, matched)
+	}
+
+	if _, _, err := runGitSync(repo.ctx, repo.Path, "rev-parse", "--verify", "--quiet", target+"^{commit}"); err == nil {
+		return repo.explainCommit(w, target)
+	}
+
+	return fmt.Errorf("%s is neither a file of the checked out tree nor a commit of %s", target, repo.Identifier)
+}
+
+func (repo *Repo) explainTree(w io.Writer, entries []treeEntry) error {
+	switch repo.Config.Indepth {
+	case IndepthCommits:
+		fmt.Fprintf(w, "%s is counted by commits, pass a commit to see what it contributes\n\n", repo.Identifier)
+	case IndepthBlame:
+		fmt.Fprintf(w, "%s is counted by blame, only lines of config.authors count towards the totals below\n\n", repo.Identifier)
+	}
+
+	for _, entry := range entries {
+		data, err := repo.readBlob(entry.Blob)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", entry.File, err)
+		}
+
+		e := repo.explainFile(entry.File, data)
+
+		var result string
+		if option := e.skippedBy(); len(option) != 0 {
+			result = "skipped by " + option
+		} else {
+			result = fmt.Sprintf("counted as %s, %d lines, %d bytes", e.lang, e.lines, e.bytes)
+			if repo.shouldSkipLang(e.lang) {
+				result += ", left out of the card"
+			}
+		}
+
+		e.print(w, entry.File, result)
+	}
+
+	return nil
+}
+
+func (repo *Repo) explainCommit(w io.Writer, rev string) error {
+	commit, author, err := repo.getCommit(rev)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "commit %s\nAuthor: %s\n\n    %s\n\n", commit.Hash, author, commit.Subject)
+
+	if repo.Config.Indepth != IndepthCommits {
+		fmt.Fprintf(w, "%s is not counted by commits, so the commit contributes nothing\n\n", repo.Identifier)
+	}
+
+	matching, err := repo.getMatchingCommits()
+	if err != nil {
+		return err
+	}
+
+	counted := false
+	idx := slices.IndexFunc(matching, func(c Commit) bool { return c.Hash == commit.Hash })
+
+	switch {
+	case idx == -1:
+		fmt.Fprintf(w, "Not matched: not by config.authors, or left out by since, until, merges, or allbranches\n\n")
+	case matching[idx].shouldSkipCommit():
+		fmt.Fprintf(w, "Skipped: listed in config.commits\n\n")
+	case len(repo.Config.Bulk.matchMessage(commit)) != 0:
+		fmt.Fprintf(w, "Skipped: subject matched bulk.messages pattern %s\n\n", repo.Config.Bulk.matchMessage(commit))
+	default:
+		commit = matching[idx]
+		counted = true
+		fmt.Fprintf(w, "Matched: %s, weighted by %g\n\n", commit.Identity, commit.Weight)
+	}
+
+	diffs, err := commit.getDiffs(repo)
+	if err != nil {
+		return err
+	}
+
+	// Commits are analyzed checked out, so files are classified by their
+	// contents at the commit
+	entries, err := repo.getTreeEntriesAt(commit.Hash)
+	if err != nil {
+		return err
+	}
+
+	blobs := map[string]string{}
+	for _, entry := range entries {
+		blobs[entry.File] = entry.Blob
+	}
+
+	kept := []Diff{}
+	unfiltered := 0
+	langs := map[string]*CommitLangResult{}
+
+	for _, diff := range diffs {
+		if len(diff.File) != 0 {
+			unfiltered++
+		}
+
+		change := fmt.Sprintf("+%d -%d lines, +%d -%d bytes", diff.Added.Lines, diff.Removed.Lines, diff.Added.Bytes, diff.Removed.Bytes)
+
+		blob, ok := blobs[diff.File]
+		if !ok {
+			fmt.Fprintf(w, "%s\n  result  skipped, not a regular file at this commit (deleted, a symlink, or a submodule), %s\n\n", diff.File, change)
+			continue
+		}
+
+		data, err := repo.readBlob(blob)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", diff.File, err)
+		}
+
+		e := repo.explainFile(diff.File, data)
+
+		if option := e.skippedBy(); len(option) != 0 {
+			e.print(w, diff.File, fmt.Sprintf("skipped by %s, %s", option, change))
+			continue
+		}
+
+		kept = append(kept, diff)
+
+		langResult := langs[e.lang]
+		if langResult == nil {
+			langResult = &CommitLangResult{}
+			langs[e.lang] = langResult
+		}
+
+		langResult.Added.Lines += diff.Added.Lines
+		langResult.Added.Bytes += diff.Added.Bytes
+		langResult.Removed.Lines += diff.Removed.Lines
+		langResult.Removed.Bytes += diff.Removed.Bytes
+		langResult.Files = append(langResult.Files, diff.File)
+
+		e.print(w, diff.File, fmt.Sprintf("counted as %s, %s", e.lang, change))
+	}
+
+	scale, reason := repo.Config.Bulk.scale(kept, unfiltered)
+	if scale == 0 {
+		fmt.Fprintf(w, "Skipped by bulk: %s\n", reason)
+		return nil
+	} else if len(reason) != 0 {
+		fmt.Fprintf(w, "Capped by bulk to %.2f%% of its counts: %s\n\n", scale*100, reason)
+	}
+
+	if counted && repo.Config.Indepth == IndepthCommits {
+		fmt.Fprintln(w, "Contribution:")
+	} else {
+		fmt.Fprintln(w, "Contribution if it were counted:")
+	}
+
+	names := make([]string, 0, len(langs))
+	for lang := range langs {
+		names = append(names, lang)
+	}
+	slices.Sort(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, lang := range names {
+		lines, size := repo.commitLangCount(langs[lang], commit.Weight*scale)
+
+		note := ""
+		if repo.shouldSkipLang(lang) {
+			note = "left out of the card"
+		}
+
+		fmt.Fprintf(tw, "  %s\t%d lines\t%d bytes\t%s\n", lang, lines, size, note)
+	}
+
+	return tw.Flush()
+}
+
+// Reads a blob from the object database, so that files can be explained
+// without touching the working tree.
+func (repo *Repo) readBlob(blob string) ([]byte, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "cat-file", "blob", blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(stdout), nil
+}
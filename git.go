@@ -2,13 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"strings"
+	"time"
 )
 
-func runGitSync(dir string, args ...string) (string, string, error) {
-	cmd := exec.Command("git", args...)
+// Runs git, stopping it when ctx is cancelled or after config.timeouts.git.
+// git is sent an interrupt rather than killed outright so that it can clean up
+// its lock files.
+func runGitSync(ctx context.Context, dir string, args ...string) (string, string, error) {
+	return runGitTimeout(ctx, config.Timeouts.Git, dir, args...)
+}
+
+// Runs git like runGitSync, with a timeout of its own. A timeout of 0 never
+// expires.
+func runGitTimeout(parent context.Context, timeout time.Duration, dir string, args ...string) (string, string, error) {
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = dir
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
 
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
@@ -16,15 +38,77 @@ func runGitSync(dir string, args ...string) (string, string, error) {
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 
-	cmd.Run()
+	runErr := cmd.Run()
 
 	out := stdout.String()
 	err := stderr.String()
 
+	if parent.Err() != nil {
+		return out, err, fmt.Errorf("git %s: %w", args[0], parent.Err())
+	}
+
+	if ctx.Err() != nil {
+		return out, err, &TransientError{Err: fmt.Errorf("git %s timed out after %s", args[0], timeout)}
+	}
+
+	if cmd.ProcessState == nil {
+		return out, err, fmt.Errorf("git %s: %w", args[0], runErr)
+	}
+
 	code := cmd.ProcessState.ExitCode()
 	if code != 0 {
-		return out, err, fmt.Errorf("git errored with code %d: %s", code, string(err))
+		// Kept on one line, so the error can be printed as is
+		msg := strings.ReplaceAll(strings.TrimSpace(err), "\n", "; ")
+		return out, err, fmt.Errorf("git %s errored with code %d: %s", args[0], code, msg)
 	}
 
 	return out, err, nil
 }
+
+// Reverses the C-style quoting git applies to paths containing special or
+// non-ASCII characters, e.g. "a/\303\274.py". Unquoted paths are returned
+// unchanged.
+func unquoteGitPath(path string) string {
+	if len(path) < 2 || path[0] != '"' || path[len(path)-1] != '"' {
+		return path
+	}
+
+	path = path[1 : len(path)-1]
+	ret := make([]byte, 0, len(path))
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+
+		if c != '\\' || i+1 >= len(path) {
+			ret = append(ret, c)
+			continue
+		}
+
+		i++
+		switch e := path[i]; e {
+		case 'a':
+			ret = append(ret, '\a')
+		case 'b':
+			ret = append(ret, '\b')
+		case 'f':
+			ret = append(ret, '\f')
+		case 'n':
+			ret = append(ret, '\n')
+		case 'r':
+			ret = append(ret, '\r')
+		case 't':
+			ret = append(ret, '\t')
+		case 'v':
+			ret = append(ret, '\v')
+		case '0', '1', '2', '3':
+			if i+2 < len(path) {
+				ret = append(ret, (e-'0')<<6|(path[i+1]-'0')<<3|(path[i+2]-'0'))
+				i += 2
+			}
+		default:
+			ret = append(ret, e)
+		}
+	}
+
+	return string(ret)
+}
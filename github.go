@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RepoResponse struct {
@@ -14,47 +16,95 @@ type RepoResponse struct {
 	Fork      bool
 }
 
-func githubGetAccountRepos(account string, org bool, token string) []RepoResponse {
+func githubGetAccountRepos(account string, org bool, token string) ([]RepoResponse, error) {
 	ret := []RepoResponse{}
 
 	shouldContinue := true
 	page := 1
 
 	for shouldContinue {
-		var response *http.Response
+		var responses []RepoResponse
 
-		if org {
-			response = githubGetOrgRepos(account, token, page)
-		} else {
-			response = githubGetUserRepos(account, token, page)
-		}
-		defer response.Body.Close()
+		what := fmt.Sprintf("Fetching page %d of the repositories of %s", page, account)
+		err := retry(context.Background(), nil, what, func() error {
+			var response *http.Response
+			var err error
 
-		link := response.Header.Get("link")
-		if len(link) == 0 || !strings.Contains(link, "rel=\"next\"") {
-			shouldContinue = false
-		}
+			if org {
+				response, err = githubGetOrgRepos(account, token, page)
+			} else {
+				response, err = githubGetUserRepos(account, token, page)
+			}
 
-		if response.StatusCode != 200 {
-			body, err := io.ReadAll(response.Body)
-			check(err)
-			bodyString := string(body)
-			fmt.Fprintf(os.Stderr, "Github api request failed: %s", bodyString)
-			os.Exit(1)
-		}
+			if err != nil {
+				return err
+			}
+
+			link := response.Header.Get("link")
+			shouldContinue = len(link) != 0 && strings.Contains(link, "rel=\"next\"")
 
-		responses := []RepoResponse{}
-		err := json.NewDecoder(response.Body).Decode(&responses)
-		check(err)
+			responses, err = githubDecodeRepos(response)
+			return err
+		})
+
+		if err != nil {
+			return nil, networkErrorf("fetching repositories of %s: %w", account, err)
+		}
 
 		ret = append(ret, responses...)
 		page++
 	}
 
-	return ret
+	return ret, nil
+}
+
+func githubDecodeRepos(response *http.Response) ([]RepoResponse, error) {
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		body, _ := io.ReadAll(response.Body)
+		err := fmt.Errorf("github api request failed with status %s: %s", response.Status, strings.TrimSpace(string(body)))
+
+		// Rate limits and server errors may clear up. GitHub reports the
+		// primary rate limit as a 403 with no requests remaining.
+		rateLimited := response.Header.Get("X-RateLimit-Remaining") == "0" || len(response.Header.Get("Retry-After")) != 0
+		if response.StatusCode == 429 || (response.StatusCode == 403 && rateLimited) || response.StatusCode >= 500 {
+			return nil, &TransientError{Err: err, Wait: githubRateLimitWait(response.Header)}
+		}
+
+		return nil, err
+	}
+
+	responses := []RepoResponse{}
+	err := json.NewDecoder(response.Body).Decode(&responses)
+	if err != nil {
+		// Most likely a response cut short by config.timeouts.api
+		return nil, &TransientError{Err: fmt.Errorf("decoding github api response: %w", err)}
+	}
+
+	return responses, nil
 }
 
-func githubGetUserRepos(username string, token string, page int) *http.Response {
+// How long GitHub asks to wait before the next request, from Retry-After or
+// the reset time of an exhausted rate limit. 0 when it does not say.
+func githubRateLimitWait(header http.Header) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return 0
+	}
+
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return max(0, time.Until(time.Unix(reset, 0)))
+}
+
+func githubGetUserRepos(username string, token string, page int) (*http.Response, error) {
 	var endpoint string
 	if len(token) > 0 {
 		endpoint = "https://api.github.com/user/repos"
@@ -62,7 +112,7 @@ func githubGetUserRepos(username string, token string, page int) *http.Response
 		endpoint = fmt.Sprintf("https://api.github.com/users/%s/repos", username)
 	}
 
-	client := http.Client{}
+	client := http.Client{Timeout: config.Timeouts.API}
 	request, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf(endpoint+"?per_page=100&page=%d",
@@ -70,7 +120,9 @@ func githubGetUserRepos(username string, token string, page int) *http.Response
 		),
 		nil,
 	)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(token) > 0 {
 		request.Header.Set("Authorization", "token "+token)
@@ -78,14 +130,11 @@ func githubGetUserRepos(username string, token string, page int) *http.Response
 
 	request.Header.Set("X-GitHub-Api-Version", "2022-11-28")
 
-	response, err := client.Do(request)
-	check(err)
-
-	return response
+	return githubDo(&client, request)
 }
 
-func githubGetOrgRepos(org string, token string, page int) *http.Response {
-	client := http.Client{}
+func githubGetOrgRepos(org string, token string, page int) (*http.Response, error) {
+	client := http.Client{Timeout: config.Timeouts.API}
 	request, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf("https://api.github.com/orgs/%s/repos?per_page=100&page=%d",
@@ -94,7 +143,9 @@ func githubGetOrgRepos(org string, token string, page int) *http.Response {
 		),
 		nil,
 	)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(token) > 0 {
 		request.Header.Set("Authorization", "token "+token)
@@ -102,8 +153,15 @@ func githubGetOrgRepos(org string, token string, page int) *http.Response {
 
 	request.Header.Set("X-GitHub-Api-Version", "2022-11-28")
 
+	return githubDo(&client, request)
+}
+
+// Sends request, marking failures to reach GitHub as transient.
+func githubDo(client *http.Client, request *http.Request) (*http.Response, error) {
 	response, err := client.Do(request)
-	check(err)
+	if err != nil {
+		return nil, &TransientError{Err: err}
+	}
 
-	return response
+	return response, nil
 }
@@ -6,6 +6,18 @@ require (
 	github.com/go-enry/go-enry/v2 v2.9.1
 	golang.org/x/sys v0.29.0
 	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.35.0
 )
 
-require github.com/go-enry/go-oniguruma v1.2.1 // indirect
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-enry/go-oniguruma v1.2.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/exp v0.0.0-20230315142452-642cacee5cc0 // indirect
+	modernc.org/libc v1.61.13 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.8.2 // indirect
+)
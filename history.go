@@ -0,0 +1,450 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Bumped whenever historySchema changes, stored as the database's
+// user_version
+const HISTORYVERSION = 1
+
+// Runs and the per-repository, per-language totals that went into their
+// cards, plus the latest results of each commit counted in-depth. Commit
+// results are replaced every run, run records the last run they were seen in.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id       INTEGER PRIMARY KEY,
+	started  INTEGER NOT NULL,
+	finished INTEGER NOT NULL,
+	config   TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS repos (
+	run     INTEGER NOT NULL REFERENCES runs(id),
+	repo    TEXT NOT NULL,
+	head    TEXT NOT NULL,
+	indepth TEXT NOT NULL,
+	files   INTEGER NOT NULL,
+	PRIMARY KEY (run, repo)
+);
+
+CREATE TABLE IF NOT EXISTS repo_langs (
+	run   INTEGER NOT NULL REFERENCES runs(id),
+	repo  TEXT NOT NULL,
+	lang  TEXT NOT NULL,
+	lines INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	PRIMARY KEY (run, repo, lang)
+);
+
+CREATE TABLE IF NOT EXISTS commits (
+	repo      TEXT NOT NULL,
+	hash      TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	lines     INTEGER NOT NULL,
+	bytes     INTEGER NOT NULL,
+	skipped   TEXT NOT NULL,
+	run       INTEGER NOT NULL REFERENCES runs(id),
+	PRIMARY KEY (repo, hash)
+);
+
+CREATE TABLE IF NOT EXISTS commit_langs (
+	repo  TEXT NOT NULL,
+	hash  TEXT NOT NULL,
+	lang  TEXT NOT NULL,
+	lines INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	PRIMARY KEY (repo, hash, lang)
+);
+`
+
+func openHistory() (*sql.DB, error) {
+	db, err := sql.Open("sqlite", config.History)
+	if err != nil {
+		return nil, err
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if version > HISTORYVERSION {
+		db.Close()
+		return nil, fmt.Errorf("history version %d is newer than the supported version %d", version, HISTORYVERSION)
+	}
+
+	_, err = db.Exec(historySchema)
+	if err == nil {
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", HISTORYVERSION))
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Appends the run to config.history.
+func (d *ConcData) writeHistory(started time.Time) error {
+	db, err := openHistory()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO runs (started, finished, config) VALUES (?, ?, ?)",
+		started.Unix(), time.Now().Unix(), configFingerprint)
+	if err != nil {
+		return err
+	}
+
+	run, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range d.repos {
+		_, err = tx.Exec("INSERT INTO repos (run, repo, head, indepth, files) VALUES (?, ?, ?, ?, ?)",
+			run, repo.Identifier, repo.LatestCommit.Hash, repo.Config.Indepth.String(), repo.UniqueFileCount)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range repo.CommitHashesOrdered {
+			err = writeHistoryCommit(tx, run, &repo, hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for lang, repos := range d.l {
+		for _, pair := range repos {
+			_, err = tx.Exec("INSERT INTO repo_langs (run, repo, lang, lines, bytes) VALUES (?, ?, ?, ?, ?)",
+				run, pair.lang, lang, pair.lines, pair.bytes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func writeHistoryCommit(tx *sql.Tx, run int64, repo *Repo, hash string) error {
+	pair := repo.CommitCounts[hash]
+	if pair == nil {
+		pair = &LineBytePair{}
+	}
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO commits (repo, hash, timestamp, lines, bytes, skipped, run) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		repo.Identifier, hash, int64(repo.CommitTimestamps[hash]), pair.Lines, pair.Bytes, repo.SkippedCommits[hash], run)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM commit_langs WHERE repo = ? AND hash = ?", repo.Identifier, hash)
+	if err != nil {
+		return err
+	}
+
+	for lang, langPair := range repo.CommitLangCounts[hash] {
+		_, err = tx.Exec("INSERT INTO commit_langs (repo, hash, lang, lines, bytes) VALUES (?, ?, ?, ?, ?)",
+			repo.Identifier, hash, lang, langPair.Lines, langPair.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Per-language totals of a run or a month of commits
+type historyPeriod struct {
+	name  string
+	langs map[string]*LineBytePair
+}
+
+func (period *historyPeriod) totals() Totals {
+	totals := Totals{}
+	for _, pair := range period.langs {
+		totals.lines += pair.Lines
+		totals.bytes += pair.Bytes
+	}
+
+	return totals
+}
+
+// Totals of the last limit runs, oldest first.
+func queryHistoryRuns(db *sql.DB, repo string, limit int) ([]*historyPeriod, error) {
+	rows, err := db.Query(`
+		SELECT runs.id, runs.started, repo_langs.lang, SUM(repo_langs.lines), SUM(repo_langs.bytes)
+		FROM runs JOIN repo_langs ON repo_langs.run = runs.id
+		WHERE runs.id IN (SELECT id FROM runs ORDER BY id DESC LIMIT ?) AND (? = '' OR repo_langs.repo = ?)
+		GROUP BY runs.id, repo_langs.lang
+		ORDER BY runs.id`, limit, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []*historyPeriod{}
+	var last int64 = -1
+
+	for rows.Next() {
+		var id, started int64
+		var lang string
+		pair := &LineBytePair{}
+
+		err = rows.Scan(&id, &started, &lang, &pair.Lines, &pair.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != last {
+			name := fmt.Sprintf("#%d %s", id, time.Unix(started, 0).Format("2006-01-02 15:04"))
+			ret = append(ret, &historyPeriod{name: name, langs: map[string]*LineBytePair{}})
+			last = id
+		}
+
+		ret[len(ret)-1].langs[lang] = pair
+	}
+
+	return ret, rows.Err()
+}
+
+// Totals of commits counted in-depth by the month they were made in, for the
+// last limit months, oldest first. Only the commits seen in each repository's
+// latest run are included, so rewritten history is not counted twice.
+func queryHistoryCommits(db *sql.DB, repo string, limit int) ([]*historyPeriod, error) {
+	rows, err := db.Query(`
+		SELECT strftime('%Y-%m', commits.timestamp, 'unixepoch') AS month, commit_langs.lang,
+			SUM(commit_langs.lines), SUM(commit_langs.bytes)
+		FROM commits JOIN commit_langs ON commit_langs.repo = commits.repo AND commit_langs.hash = commits.hash
+		WHERE commits.run = (SELECT MAX(run) FROM commits AS latest WHERE latest.repo = commits.repo)
+			AND (? = '' OR commits.repo = ?)
+		GROUP BY month, commit_langs.lang
+		ORDER BY month`, repo, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []*historyPeriod{}
+
+	for rows.Next() {
+		var month, lang string
+		pair := &LineBytePair{}
+
+		err = rows.Scan(&month, &lang, &pair.Lines, &pair.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ret) == 0 || ret[len(ret)-1].name != month {
+			ret = append(ret, &historyPeriod{name: month, langs: map[string]*LineBytePair{}})
+		}
+
+		ret[len(ret)-1].langs[lang] = pair
+	}
+
+	if len(ret) > limit {
+		ret = ret[len(ret)-limit:]
+	}
+
+	return ret, rows.Err()
+}
+
+func historyMain(args []string) {
+	var repo string
+	var langs stringList
+	var limit = 12
+	var byCommits = false
+	var asCSV = false
+
+	fs := newFlagSet("history", `
+Print how language totals changed over previous runs, from config.history
+
+Usage: ./ppebtrics history [OPTIONS]
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+ -r|--repo             Only include the given repository
+ -l|--lang             Show the given language, may be repeated. Defaults to
+                       the top config.langscount languages
+ -n|--limit            Number of runs or months to show, defaults to 12
+    --commits          Group in-depth commit results by month instead of by run
+    --csv              Print every language as CSV instead of a table
+`)
+
+	configPath := configFlag(fs)
+	stringFlag(fs, &repo, "repo", "r", "")
+	fs.Var(&langs, "lang", "")
+	fs.Var(&langs, "l", "")
+	fs.IntVar(&limit, "limit", limit, "")
+	fs.IntVar(&limit, "n", limit, "")
+	boolFlag(fs, &byCommits, "commits", "")
+	boolFlag(fs, &asCSV, "csv", "")
+
+	rejectPositional("history", parseFlags(fs, args))
+
+	if limit <= 0 {
+		exitWithError(configErrorf("--limit must be a positive number, got %d", limit))
+	}
+
+	err := loadConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(config.History) == 0 {
+		fmt.Println("config.history is not set, there is no history to show.")
+		os.Exit(1)
+	}
+
+	if !fileExists(config.History) {
+		fmt.Printf("%s does not exist yet, it is created by the next run.\n", config.History)
+		os.Exit(1)
+	}
+
+	db, err := openHistory()
+	if err != nil {
+		exitWithError(fmt.Errorf("opening %s: %w", config.History, err))
+	}
+	defer db.Close()
+
+	var periods []*historyPeriod
+	if byCommits {
+		periods, err = queryHistoryCommits(db, repo, limit)
+	} else {
+		periods, err = queryHistoryRuns(db, repo, limit)
+	}
+
+	if err != nil {
+		exitWithError(fmt.Errorf("reading %s: %w", config.History, err))
+	}
+
+	if len(periods) == 0 {
+		fmt.Println("No history recorded yet.")
+		return
+	}
+
+	if asCSV {
+		err = printHistoryCSV(periods)
+		if err != nil {
+			exitWithError(err)
+		}
+	} else {
+		printHistoryTable(periods, langs)
+	}
+}
+
+func printHistoryCSV(periods []*historyPeriod) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"period", "lang", "lines", "bytes"})
+
+	for _, period := range periods {
+		langs := make([]string, 0, len(period.langs))
+		for lang := range period.langs {
+			langs = append(langs, lang)
+		}
+		slices.Sort(langs)
+
+		for _, lang := range langs {
+			pair := period.langs[lang]
+			w.Write([]string{period.name, lang, strconv.Itoa(pair.Lines), strconv.Itoa(pair.Bytes)})
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func printHistoryTable(periods []*historyPeriod, langs []string) {
+	if len(langs) == 0 {
+		// The top languages across every period shown
+		sums := map[string]*LineBytePairForLang{}
+		for _, period := range periods {
+			for lang, pair := range period.langs {
+				if shouldSkipLang(lang) || slices.Contains(config.Ignore.Langs, lang) {
+					continue
+				}
+
+				if sums[lang] == nil {
+					sums[lang] = &LineBytePairForLang{lang: lang}
+				}
+
+				sums[lang].lines += pair.Lines
+				sums[lang].bytes += pair.Bytes
+			}
+		}
+
+		top := []LineBytePairForLang{}
+		for _, sum := range sums {
+			top = append(top, *sum)
+		}
+
+		slices.SortFunc(top, func(a, b LineBytePairForLang) int {
+			if config.Style.Count == "bytes" {
+				return cmp.Or(cmp.Compare(b.bytes, a.bytes), strings.Compare(a.lang, b.lang))
+			}
+
+			return cmp.Or(cmp.Compare(b.lines, a.lines), strings.Compare(a.lang, b.lang))
+		})
+
+		for i := 0; i < len(top) && i < config.LangsCount; i++ {
+			langs = append(langs, top[i].lang)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\t%s\n", strings.Join(langs, "\t"))
+
+	for _, period := range periods {
+		totals := period.totals()
+		cells := []string{period.name}
+
+		for _, lang := range langs {
+			pair := period.langs[lang]
+			if pair == nil {
+				cells = append(cells, "-")
+				continue
+			}
+
+			lt := LineBytePairForLang{lang: lang, lines: pair.Lines, bytes: pair.Bytes}
+			cell := fmtCount(lt)
+
+			if totals.lines != 0 && totals.bytes != 0 {
+				_, perc := calcFmtPerc(lt, totals)
+				cell = fmt.Sprintf("%s%% (%s)", perc, cell)
+			}
+
+			cells = append(cells, cell)
+		}
+
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+
+	w.Flush()
+}
@@ -1,47 +1,173 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
 )
 
-const TMPFILE = "/tmp/metrics_lock"
+// Whether this process holds the lock, read by the signal handler
+var lockHeld atomic.Bool
 
-func lock(force bool) error {
-	_, err := os.Stat(TMPFILE)
+// The open lock file while the lock is held. The flock is released by the
+// kernel when the file is closed, including when the process dies, so a
+// crashed run never leaves the lock held. Guarded by lockMu, as a second
+// signal unlocks from the signal handler while runMain may be unlocking too.
+var lockFd *os.File
+var lockMu sync.Mutex
+
+// Who holds the lock, written to the lock file for the error shown to other
+// processes
+type LockOwner struct {
+	PID      int
+	Hostname string
+	Started  time.Time
+}
+
+func (owner LockOwner) String() string {
+	return fmt.Sprintf("PID %d on %s, started %s", owner.PID, owner.Hostname, owner.Started.Local().Format(time.DateTime))
+}
 
-	// 3 cases
-	// Lock file exists and is read
-	// Lock file failed to read
-	// Lock file does not exist
+// The lock file sits next to config.location, so that runs with different
+// locations do not block each other.
+func lockPath() string {
+	return path.Clean(config.Location) + ".lock"
+}
+
+func readLockOwner(file *os.File) (LockOwner, bool) {
+	owner := LockOwner{}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil || len(data) == 0 {
+		return owner, false
+	}
 
-	if err != nil && !os.IsNotExist(err) {
-		// Failed to read lock file
-		return err
+	if yaml.Unmarshal(data, &owner) != nil || owner.PID == 0 {
+		return owner, false
 	}
 
-	if err == nil {
-		if !force {
+	return owner, true
+}
+
+func lock(force bool) error {
+	lpath := lockPath()
+
+	for {
+		file, err := os.OpenFile(lpath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			owner, ok := readLockOwner(file)
+			file.Close()
+
+			holder := "another process"
+			if ok {
+				holder = owner.String()
+			}
+
+			if force {
+				logEcho(Warning, nil, fmt.Sprintf("Ignoring lock file %s held by %s", lpath, holder), true)
+				lockHeld.Store(true)
+				return nil
+			}
+
 			return fmt.Errorf(
-				"Lock file '%s' is currently held by another process. "+
-					"Only remove it or run with --force if you are sure no other instance is running!",
-				TMPFILE,
+				"lock file %s is held by %s. Only run with --force if you are sure no other instance is using %s",
+				lpath,
+				holder,
+				config.Location,
 			)
-		} else {
-			return nil
+		} else if err != nil {
+			file.Close()
+			return fmt.Errorf("locking %s: %w", lpath, err)
+		}
+
+		// The previous holder may have removed the file between it being
+		// opened and locked here, in which case the lock is on a file nobody
+		// else can see
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		current, err := os.Stat(lpath)
+		if err != nil || !os.SameFile(opened, current) {
+			file.Close()
+			continue
 		}
+
+		// The holder died without removing the file
+		if owner, ok := readLockOwner(file); ok {
+			logEcho(Warning, nil, fmt.Sprintf("Removing stale lock left by %s", owner), true)
+		}
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+
+		data, err := yaml.Marshal(LockOwner{
+			PID:      os.Getpid(),
+			Hostname: hostname,
+			Started:  time.Now(),
+		})
+
+		if err == nil {
+			err = file.Truncate(0)
+		}
+
+		if err == nil {
+			_, err = file.WriteAt(data, 0)
+		}
+
+		if err != nil {
+			os.Remove(lpath)
+			file.Close()
+			return fmt.Errorf("writing %s: %w", lpath, err)
+		}
+
+		lockMu.Lock()
+		lockFd = file
+		lockMu.Unlock()
+		lockHeld.Store(true)
+
+		return nil
 	}
+}
+
+func unlock() error {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+
+	lockHeld.Store(false)
 
+	// Not held by this process, see --force
+	if lockFd == nil {
+		return nil
+	}
+
+	// Removed while still locked, so nobody can lock the old file after it
+	// is gone
+	err := os.Remove(lockPath())
 	if os.IsNotExist(err) {
-		// Create lock file
-		_, err := os.Create(TMPFILE)
-		return err
+		err = nil
 	}
 
-	// Unreachable
-	panic("Unreachable")
-}
+	if closeErr := lockFd.Close(); err == nil {
+		err = closeErr
+	}
 
-func unlock() error {
-	return os.Remove(TMPFILE)
+	lockFd = nil
+	return err
 }
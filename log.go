@@ -28,7 +28,7 @@ var termHeight int
 var cursorY int
 var silent bool
 
-func initLog(isSilent bool) {
+func initLog(isSilent bool) error {
 	progMu = sync.Mutex{}
 	counter = -1
 	silent = isSilent
@@ -36,10 +36,14 @@ func initLog(isSilent bool) {
 	dt := time.Now()
 
 	err := os.MkdirAll("./logs", os.FileMode(0755))
-	check(err)
+	if err != nil {
+		return fmt.Errorf("creating the log directory: %w", err)
+	}
 
 	logFd, err := os.Create(fmt.Sprintf("./logs/%d-%02d-%02d %02d:%02d:%02d.log", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second()))
-	check(err)
+	if err != nil {
+		return fmt.Errorf("creating the log file: %w", err)
+	}
 
 	fd = fdSafe{
 		mu: sync.Mutex{},
@@ -47,31 +51,56 @@ func initLog(isSilent bool) {
 	}
 
 	if silent {
-		return
+		return nil
 	}
 
 	o, err := os.Stdout.Stat()
-	check(err)
+	if err != nil {
+		return fmt.Errorf("reading stdout: %w", err)
+	}
 
 	isTerminal = o.Mode()&os.ModeCharDevice == os.ModeCharDevice
 
 	if isTerminal {
 		ws, err := unix.IoctlGetWinsize(0, unix.TIOCGWINSZ)
-		check(err)
+		if err != nil {
+			// e.g. /dev/null, which is a character device but not a terminal
+			isTerminal = false
+			return nil
+		}
 
 		termWidth = int(ws.Col)
 		termHeight = int(ws.Row)
 		fmt.Print("\x1b[?25l")
 	}
+
+	return nil
 }
 
+// Returns the row of the cursor, or -1 if progress is not displayed. Progress
+// is disabled if the position cannot be read.
 func logGetCursorPos() int {
 	if !isTerminal {
 		return -1
 	}
 
+	row, err := queryCursorPos()
+	if err != nil {
+		log(Warning, nil, fmt.Sprintf("Unable to determine the cursor position, not displaying progress: %s", err))
+		logResetCursor()
+		isTerminal = false
+
+		return -1
+	}
+
+	return row
+}
+
+func queryCursorPos() (int, error) {
 	tIOS, err := unix.IoctlGetTermios(0, unix.TCGETS)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
 
 	tIOSOrig := *tIOS
 
@@ -83,20 +112,23 @@ func logGetCursorPos() int {
 	fmt.Print("\x1b[6n")
 
 	text, err := reader.ReadSlice('R')
-
-	check(err)
+	if err != nil {
+		return 0, err
+	}
 
 	// parse the row and column
-	if strings.Contains(string(text), ";") {
-		re := regexp.MustCompile(`\d+;\d+`)
-		line := re.FindString(string(text))
-		row, err := strconv.Atoi(strings.Split(line, ";")[0])
-		check(err)
+	if !strings.Contains(string(text), ";") {
+		return 0, fmt.Errorf("unexpected response %q", text)
+	}
 
-		return row - 1
-	} else {
-		panic("Unable to determine cursor position")
+	re := regexp.MustCompile(`\d+;\d+`)
+	line := re.FindString(string(text))
+	row, err := strconv.Atoi(strings.Split(line, ";")[0])
+	if err != nil {
+		return 0, err
 	}
+
+	return row - 1, nil
 }
 
 func logResetCursor() {
@@ -2,114 +2,86 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
-func printHelp() {
-	fmt.Printf(`
-ppeb's git language metrics generator!!!
-
-Usage: ./ppebtrics [OPTIONS]
- -h|--help             Display this message and exit
- -c|--config           Specify the path to your config.yml
- -o|--output           Specify the output path of your svg
- -d|--dry-run          Dry run! List the repos to be cloned and analyzed
+const runOptions = ` -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml, defaults to
+                       ./config.yml or ~/.config/ppebtrics/config.yml
+ -o|--output           Specify the output path of your svg, defaults to
+                       ./langs.svg
  -s|--silent           Don't output to stdout
- -f|--force            Ignore the lockfile, run even if it is present
-`)
+ -f|--force            Ignore the lock, run even if another instance holds it
+    --no-cache         Ignore cached results and recount every repository
+    --strict           Stop every repository and exit as soon as one fails
+`
 
-	os.Exit(1)
-}
-
-func main() {
-	var configPath string
-	var dryRun = false
+func runMain(args []string) {
 	var silent = false
 	var force = false
+	var noCache = false
+	var strict = false
 
-	argsLen := len(os.Args)
+	fs := newFlagSet("run", `
+Clone and count every repository, then render the card
 
-	if argsLen <= 1 {
-		fmt.Println("No arguments provided! --config is required to continue.")
-		printHelp()
-	}
+Usage: ./ppebtrics [run] [OPTIONS]
+`+runOptions)
 
-	for i := 1; i < argsLen; i++ {
-		arg := os.Args[i]
-		switch arg {
-		case "-h", "--help":
-			printHelp()
-		case "-c", "--config":
-			if argsLen > i+1 {
-				configPath = os.Args[i+1]
-				i++
-			}
-		case "-o", "--output":
-			if argsLen > i+1 {
-				outputPath = os.Args[i+1]
-				i++
-			}
-		case "-d", "--dry-run":
-			dryRun = true
-		case "-s", "--silent":
-			silent = true
-		case "-f", "--force":
-			force = true
-		default:
-			fmt.Printf("Unknown argument %s!\n", arg)
-			printHelp()
-		}
-	}
+	configPath := configFlag(fs)
+	stringFlag(fs, &outputPath, "output", "o", "./langs.svg")
+	boolFlag(fs, &silent, "silent", "s")
+	boolFlag(fs, &force, "force", "f")
+	boolFlag(fs, &noCache, "no-cache", "")
+	boolFlag(fs, &strict, "strict", "")
 
-	if len(configPath) == 0 {
-		panic("Missing config argument, provide a config.yml with -c or --config")
-	}
+	rejectPositional("run", parseFlags(fs, args))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if len(outputPath) == 0 {
-		fmt.Println("No output path specified! Defaulting to ./langs.svg")
-		outputPath = "./langs.svg"
+	err := initLog(silent)
+	if err != nil {
+		exitWithError(err)
 	}
 
-	initLog(silent)
 	defer logClose()
-	initConfig(configPath)
+	handleSignals(cancel)
 
-	if dryRun {
-		fmt.Println("The following repositories will be cloned and analyzed:")
-		for _, v := range reposToCheck {
-			fmt.Printf("    %s\n", v)
-		}
+	err = initConfig(resolveConfigPath(*configPath))
+	if err == nil {
+		err = createDirs()
+	}
 
-		logResetCursor()
-		return
+	if err != nil {
+		exitWithError(err)
 	}
 
 	// Begin accessing potentially shared state, lock
-	err := lock(force)
-
+	err = lock(force)
 	if err != nil {
-		logEcho(Critical, nil, fmt.Sprintf("Failed to acquire lockfile: %s", err), true)
-		logResetCursor()
-		return
+		exitWithError(err)
 	}
 
 	cursorY = logGetCursorPos()
+	started := time.Now()
 
 	state := State{}
 	err = state.read()
 	hasState := err == nil
 
+	if err != nil && !os.IsNotExist(err) {
+		logEcho(Warning, nil, fmt.Sprintf("Unable to read state, every repository will be recounted: %s", err), true)
+	}
+
 	cumulative := ConcData{
 		mu:    sync.Mutex{},
 		v:     map[string]*LineBytePair{},
@@ -118,99 +90,100 @@ func main() {
 		repos: []Repo{},
 	}
 
-	var cancelChannel chan bool
-	closed := false
-	closeOnce := sync.OnceFunc(func() { close(cancelChannel); closed = true })
+	var failed error
+	failOnce := sync.OnceFunc(func() { cancel() })
 
-	countRepo := func(workerID int, repos <-chan string, cancel <-chan bool, wg *sync.WaitGroup) {
-		defer wg.Done()
+	// Counts a single repository. Errors only fail that repository, unless
+	// --strict is passed, in which case every worker is stopped.
+	countOne := func(workerID int, id string) {
+		log(Info, nil, fmt.Sprintf("WorkerID %d: preparing to initialize repo %s", workerID, id))
+		repo := Repo{
+			Identifier: id,
+			Config:     repoConfigs[id],
+		}
 
-		var lastRepo *Repo
+		var oldRepo *SerializedRepo = nil
 
-		defer func() {
-			if r := recover(); r != nil {
-				log(Critical, lastRepo, fmt.Sprintf("Panic caught in WorkerID %d: %s, exiting...\n%s", workerID, r, debug.Stack()))
+		if tmp, ok := state.Repos[repo.Identifier]; hasState && ok && !noCache {
+			oldRepo = &tmp
+		}
+
+		counts, err := countRepoSafely(ctx, &repo, oldRepo)
+		if err == nil {
+			if counts == nil {
+				// Empty repository
+				return
+			}
+
+			cumulative.mu.Lock()
+			cumulative.addCounts(&repo, counts, repo.UniqueFileCount)
+			cumulative.repos = append(cumulative.repos, repo)
+			cumulative.mu.Unlock()
+
+			return
+		}
+
+		repo.restoreBranch()
 
-				if lastRepo != nil {
-					log(Info, lastRepo, fmt.Sprintf("Reverting to branch %s", lastRepo.LatestBranch))
-					lastRepo.checkoutBranch(lastRepo.LatestBranch)
-				}
+		// The signal also reaches git, which may exit with an error before
+		// ctx is cancelled
+		if ctx.Err() != nil || interrupted.Load() {
+			// Stopped by a signal or by another repository failing
+			log(Info, &repo, fmt.Sprintf("WorkerID %d stopped: %s", workerID, err))
+			logProgess(&repo, "Stopped", -1)
 
-				pstr := strings.ReplaceAll(fmt.Sprint(r), "\n", "")
-				logProgess(lastRepo, fmt.Sprintf("Panic caught, %s, exiting...", pstr), -1)
-				closeOnce()
+			cumulative.mu.Lock()
+			cumulative.partial = append(cumulative.partial, repo)
+			cumulative.mu.Unlock()
+
+			return
+		}
+
+		log(Critical, &repo, fmt.Sprintf("WorkerID %d failed: %s", workerID, err))
+		estr := strings.ReplaceAll(err.Error(), "\n", " ")
+
+		cumulative.mu.Lock()
+		defer cumulative.mu.Unlock()
+
+		if strict {
+			logProgess(&repo, fmt.Sprintf("Failed, %s, exiting...", estr), -1)
+			if failed == nil {
+				failed = fmt.Errorf("%s: %w", id, err)
 			}
-		}()
+			failOnce()
+			return
+		}
+
+		logProgess(&repo, fmt.Sprintf("Failed, %s", estr), -1)
+
+		failure := RepoFailure{Identifier: id, Err: err}
+
+		// Fall back to the counts of the last complete run
+		if cached, ok := state.Repos[id]; ok && (cached.LangCounts != nil || len(cached.Head) != 0) {
+			failure.Cached = &cached
+			cumulative.addCounts(&repo, cached.LangCounts, cached.UniqueFileCount)
+		}
+
+		cumulative.failures = append(cumulative.failures, failure)
+	}
+	countRepo := func(workerID int, repos <-chan string, wg *sync.WaitGroup) {
+		defer wg.Done()
 
-	REPOSLOOP:
 		for id := range repos {
-			select {
-			case _, ok := <-cancel:
-				if !ok {
-					logProgess(lastRepo, "Exited", -1)
-					break REPOSLOOP
-				}
-			default:
-				log(Info, nil, fmt.Sprintf("WorkerID %d: preparing to initialize repo %s", workerID, id))
-				repo := Repo{
-					Identifier: id,
-				}
-
-				lastRepo = &repo
-				var oldRepo *SerializedRepo = nil
-
-				if hasState {
-					tmp := state.Repos[repo.Identifier]
-					oldRepo = &tmp
-				}
-				repo.init(oldRepo)
-
-				if len(repo.LatestCommit.Hash) == 0 {
-					continue
-				}
-
-				var counts map[string]*LineBytePair
-				if config.Indepth {
-					counts = repo.countByCommit()
-				} else {
-					counts = repo.count()
-				}
-
-				cumulative.mu.Lock()
-				for k, v := range counts {
-					if cumulative.v[k] == nil {
-						cumulative.v[k] = &LineBytePair{}
-					}
-
-					cumulative.v[k].Lines += v.Lines
-					cumulative.v[k].Bytes += v.Bytes
-
-					if cumulative.l[k] == nil {
-						cumulative.l[k] = []LineBytePairForLang{}
-					}
-
-					cumulative.l[k] = append(cumulative.l[k], LineBytePairForLang{
-						lang:  repo.Identifier,
-						lines: v.Lines,
-						bytes: v.Bytes,
-					})
-
-				}
-
-				cumulative.f += repo.UniqueFileCount
-				cumulative.repos = append(cumulative.repos, repo)
-				cumulative.mu.Unlock()
+			if ctx.Err() != nil {
+				break
 			}
+
+			countOne(workerID, id)
 		}
 	}
 
 	repoChannel := make(chan string, len(reposToCheck))
-	cancelChannel = make(chan bool)
 	var wg sync.WaitGroup
 
 	for i := 0; i < int(config.Parallel); i++ {
 		wg.Add(1)
-		go countRepo(i, repoChannel, cancelChannel, &wg)
+		go countRepo(i, repoChannel, &wg)
 	}
 
 	for _, id := range reposToCheck {
@@ -222,11 +195,46 @@ func main() {
 
 	logResetTermIfNeeded()
 
-	if closed {
-		os.Exit(1)
+	if interrupted.Load() || failed != nil {
+		logEcho(Warning, nil, "Stopped early, writing the state of the repositories counted so far", true)
+		err = cumulative.writeState(&state)
+		if err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Error writing data: %s", err.Error()), true)
+		}
+
+		if err := unlock(); err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Failed to remove lockfile: %s", err), true)
+		}
+
+		if interrupted.Load() {
+			os.Exit(ExitInterrupted)
+		}
+
+		exitWithError(failed)
 	}
 
-	createSVG(cumulative.v, cumulative.f)
+	slices.SortFunc(cumulative.failures, func(a, b RepoFailure) int {
+		return strings.Compare(a.Identifier, b.Identifier)
+	})
+
+	for _, failure := range cumulative.failures {
+		var fallback string
+		if failure.Cached != nil {
+			fallback = fmt.Sprintf("using cached counts from %s", failure.Cached.Analyzed.Format(time.DateTime))
+			if failure.Cached.Analyzed.IsZero() {
+				fallback = "using cached counts"
+			}
+		} else {
+			fallback = "no cached counts, left out of the card"
+		}
+
+		logEcho(Critical, nil, fmt.Sprintf("Failed to count %s (%s): %s", failure.Identifier, fallback, failure.Err), true)
+	}
+
+	err = createSVG(cumulative.v, cumulative.f)
+	if err != nil {
+		exitWithError(fmt.Errorf("creating %s: %w", outputPath, err))
+	}
 
 	for k, v := range cumulative.l {
 		totals := cumulative.v[k]
@@ -257,6 +265,8 @@ func main() {
 
 			if v != nil {
 				fmt.Fprintf(&msg, "Commit: %s, Lines: %d, Bytes: %d\n", hash, v.Lines, v.Bytes)
+			} else if reason, ok := repo.SkippedCommits[hash]; ok {
+				fmt.Fprintf(&msg, "Commit: %s, Skipped: %s\n", hash, reason)
 			} else {
 				fmt.Fprintf(&msg, "Commit: %s, Lines: nil, Bytes: nil\n", hash)
 			}
@@ -265,11 +275,18 @@ func main() {
 		log(Info, nil, msg.String())
 	}
 
-	err = cumulative.writeState()
+	err = cumulative.writeState(&state)
 	if err != nil {
 		logEcho(Critical, nil, fmt.Sprintf("Error writing data: %s", err.Error()), true)
 	}
 
+	if len(config.History) != 0 {
+		err = cumulative.writeHistory(started)
+		if err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Error writing history to %s: %s", config.History, err.Error()), true)
+		}
+	}
+
 	if len(config.PostExec) != 0 {
 		logEcho(Info, nil, fmt.Sprintf("Running PostExec '%s'", config.PostExec), true)
 
@@ -301,4 +318,81 @@ func main() {
 	if err := unlock(); err != nil {
 		logEcho(Critical, nil, fmt.Sprintf("Failed to remove lockfile: %s", err), true)
 	}
+
+	if len(cumulative.failures) != 0 {
+		os.Exit(failuresExitCode(cumulative.failures))
+	}
+}
+
+// Initializes and counts a repository, returning nil counts for empty
+// repositories. Panics are recovered and returned as errors, so that a bug
+// only fails the repository it happened in.
+func countRepoSafely(ctx context.Context, repo *Repo, oldRepo *SerializedRepo) (counts map[string]*LineBytePair, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log(Critical, repo, fmt.Sprintf("Panic caught: %s\n%s", r, debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	err = repo.init(ctx, oldRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(repo.LatestCommit.Hash) == 0 {
+		return nil, nil
+	}
+
+	switch repo.Config.Indepth {
+	case IndepthCommits:
+		return repo.countByCommit()
+	case IndepthBlame:
+		return repo.countByBlame()
+	default:
+		return repo.count()
+	}
+}
+
+// Network errors are reported with their own exit code only when every
+// failure was one, so that a flaky connection can be told apart from a bug.
+func failuresExitCode(failures []RepoFailure) int {
+	for _, failure := range failures {
+		if exitCode(failure.Err) != ExitNetwork {
+			return ExitAnalysis
+		}
+	}
+
+	return ExitNetwork
+}
+
+func listMain(args []string) {
+	fs := newFlagSet("list", `
+List the repositories which would be counted, after config.filters and
+config.excludeforks are applied
+
+Usage: ./ppebtrics list [OPTIONS]
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+`)
+
+	configPath := configFlag(fs)
+	rejectPositional("list", parseFlags(fs, args))
+
+	// Only the list itself is printed, so that it may be piped
+	err := initLog(true)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	defer logClose()
+
+	err = initConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	for _, id := range reposToCheck {
+		fmt.Println(id)
+	}
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+)
+
+func renderMain(args []string) {
+	var silent = false
+
+	fs := newFlagSet("render", `
+Render the card from the counts cached by the last run, without fetching or
+counting any repository. Style, theme, langscount, weights, filters, and
+ignored languages are applied again from the config.
+
+Usage: ./ppebtrics render [OPTIONS]
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+ -o|--output           Specify the output path of your svg, defaults to
+                       ./langs.svg
+ -s|--silent           Don't output to stdout
+`)
+
+	configPath := configFlag(fs)
+	stringFlag(fs, &outputPath, "output", "o", "./langs.svg")
+	boolFlag(fs, &silent, "silent", "s")
+	rejectPositional("render", parseFlags(fs, args))
+
+	err := initLog(silent)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	defer logClose()
+
+	err = loadConfig(resolveConfigPath(*configPath))
+	if err == nil {
+		err = initRepoConfigs()
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// State is replaced atomically, so it can be read without the lock
+	state := State{}
+	err = state.read()
+	if os.IsNotExist(err) {
+		exitWithError(fmt.Errorf("there is no cached state at %s yet, run ./ppebtrics run first", config.State))
+	} else if err != nil {
+		exitWithError(err)
+	}
+
+	cumulative, err := renderCounts(&state)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	err = createSVG(cumulative.v, cumulative.f)
+	if err != nil {
+		exitWithError(fmt.Errorf("creating %s: %w", outputPath, err))
+	}
+
+	logEcho(Info, nil, fmt.Sprintf("Rendered %s from the cached counts of %d repositories", outputPath, len(cumulative.repos)), true)
+}
+
+// Totals the cached counts of each repository. Repositories of config.users
+// and config.orgs can not be listed offline, so every cached repository is
+// included unless it matches config.filters. Use ./ppebtrics cache prune to
+// drop repositories which are no longer counted.
+func renderCounts(state *State) (*ConcData, error) {
+	filters, err := compileFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(state.Repos))
+	for id := range state.Repos {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	cumulative := &ConcData{
+		v:     map[string]*LineBytePair{},
+		l:     map[string][]LineBytePairForLang{},
+		repos: []Repo{},
+	}
+
+	for _, id := range ids {
+		cached := state.Repos[id]
+		rc, configured := repoConfigs[id]
+
+		if !configured {
+			if slices.ContainsFunc(filters, func(regex *regexp.Regexp) bool { return regex.MatchString(id) }) {
+				log(Info, nil, fmt.Sprintf("Skipping repository %s, matched a filter", id))
+				continue
+			}
+
+			rc, err = makeRepoConfig(&RepoEntry{Name: id})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if cached.LangCounts == nil {
+			logEcho(Warning, nil, fmt.Sprintf("Skipping repository %s, it has no cached counts", id), true)
+			continue
+		}
+
+		analyzed := "unknown"
+		if !cached.Analyzed.IsZero() {
+			analyzed = cached.Analyzed.Format(time.DateTime)
+		}
+
+		log(Info, nil, fmt.Sprintf("Using the counts of %s analyzed at %s", id, analyzed))
+
+		repo := Repo{Identifier: id, Config: rc}
+		cumulative.addCounts(&repo, cached.LangCounts, cached.UniqueFileCount)
+		cumulative.repos = append(cumulative.repos, repo)
+	}
+
+	for _, id := range reposToCheck {
+		if _, ok := state.Repos[id]; !ok {
+			logEcho(Warning, nil, fmt.Sprintf("Repository %s has not been counted yet and is left out", id), true)
+		}
+	}
+
+	return cumulative, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -9,13 +10,17 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-enry/go-enry/v2"
 )
 
 type Repo struct {
 	Identifier          string
+	Config              *RepoConfig
 	Path                string
+	ObjectFormat        string
+	EmptyTree           string
 	VendoredFilters     []*regexp.Regexp
 	Files               []string
 	UniqueFiles         []string
@@ -27,29 +32,52 @@ type Repo struct {
 	CurrentBranch       string
 	LatestBranch        string
 	CommitCounts        map[string]*LineBytePair
+	CommitLangCounts    map[string]map[string]*LineBytePair
+	CommitTimestamps    map[string]uint64
+	SkippedCommits      map[string]string
+	BlameCache          map[string]LineBytePair
+	CommitCache         map[string]*CommitResult
+	SnapshotTree        string
+	SnapshotCache       map[string]SnapshotFile
+	Fingerprint         map[string]string
 	LangCounts          map[string]*LineBytePair
 	CommitHashesOrdered []string
 	// Bit of a misnomer. This is also used to track the position when
 	// outputting to the console. :)
 	LogID int
 
-	oldRepo *SerializedRepo
+	ctx             context.Context
+	oldRepo         *SerializedRepo
+	changedSettings []string
 }
 
-func (repo *Repo) init(oldRepo *SerializedRepo) {
+func (repo *Repo) init(ctx context.Context, oldRepo *SerializedRepo) error {
+	repo.ctx = ctx
 	repo.Path = repoPath(repo.Identifier)
 
 	repo.UniqueFiles = []string{}
 	repo.FileLangMap = map[string][]string{}
 	repo.FileSkipMap = map[string]bool{}
 	repo.CommitCounts = map[string]*LineBytePair{}
+	repo.CommitLangCounts = map[string]map[string]*LineBytePair{}
+	repo.CommitTimestamps = map[string]uint64{}
+	repo.SkippedCommits = map[string]string{}
 	repo.CommitHashesOrdered = []string{}
 	repo.LogID = -1
 
-	repo.pullOrClone()
+	err := repo.pullOrClone()
+	if err != nil {
+		return err
+	}
+
 	repo.oldRepo = oldRepo
+	err = repo.compareFingerprint()
+	if err != nil {
+		return err
+	}
 
 	log(Info, repo, fmt.Sprintf("Initialized repository at %s", repo.Path))
+	return nil
 }
 
 func (repo *Repo) insertUniqueFile(file string) {
@@ -62,11 +90,14 @@ func (repo *Repo) insertUniqueFile(file string) {
 	}
 }
 
-func (repo *Repo) updateFiles() {
-	stdout, _, err := runGitSync(repo.Path, "ls-files")
-	check(err)
+func (repo *Repo) updateFiles() error {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "ls-files")
+	if err != nil {
+		return fmt.Errorf("listing files: %w", err)
+	}
 
 	repo.Files = strings.Split(stdout, "\n")
+	return nil
 }
 
 var vendoredRegexp *regexp.Regexp
@@ -102,359 +133,910 @@ func (repo *Repo) vendoredFilters() []*regexp.Regexp {
 			split := strings.Fields(line)[0]
 			split = strings.ReplaceAll(split, ".", "\\.")
 			split = strings.ReplaceAll(split, "*", ".*")
-			filters = append(filters, regexp.MustCompile(split))
+			regex, err := regexp.Compile(split)
+			if err != nil {
+				log(Warning, repo, fmt.Sprintf("Ignoring invalid linguist-vendored pattern %s in .gitattributes: %s", split, err))
+				continue
+			}
+
+			filters = append(filters, regex)
 		}
 	}
 
 	return filters
 }
 
+// Repository names are validated when the config is loaded or passed on the
+// command line, see checkRepoID.
 func repoPath(repoID string) string {
-	splits := strings.Split(repoID, "/")
+	author, name, _ := strings.Cut(repoID, "/")
 
-	if len(splits) != 2 {
-		panic(
-			fmt.Sprintf(
-				"Improper repository provided: %s. Ensure repositories follow the format author/repo",
-				repoID,
-			),
-		)
-	}
-
-	return path.Join(config.Location, fmt.Sprintf("%s-%s", splits[0], splits[1]))
+	return path.Join(config.Location, fmt.Sprintf("%s-%s", author, name))
 }
 
-func (repo *Repo) pullOrClone() {
-	var latestBranch string
-
+func (repo *Repo) pullOrClone() error {
 	if !fileExists(repo.Path) {
 		msg := "Cloning repository"
 		logProgess(repo, msg, 0)
 		log(Info, repo, msg)
-		_, _, err := runGitSync("", "clone", "https://github.com/"+repo.Identifier+".git", repo.Path)
-		check(err)
+		err := retry(repo.ctx, repo, "Cloning", func() error {
+			// Left behind by an earlier attempt
+			if err := os.RemoveAll(repo.Path); err != nil {
+				return err
+			}
+
+			_, stderr, err := runGitTimeout(repo.ctx, config.Timeouts.Network, "", "clone", "https://github.com/"+repo.Identifier+".git", repo.Path)
+			return gitNetworkError(err, stderr)
+		})
+
+		if err != nil {
+			return networkErrorf("cloning: %w", err)
+		}
 	} else {
 		msg := fmt.Sprintf("Pulling repository at %s", repo.Path)
 		logProgess(repo, msg, 0)
 		log(Info, repo, msg)
-		_, _, err := runGitSync(repo.Path, "fetch", "origin")
+		err := retry(repo.ctx, repo, "Fetching", func() error {
+			_, stderr, err := runGitTimeout(repo.ctx, config.Timeouts.Network, repo.Path, "fetch", "--prune", "--tags", "origin")
+			return gitNetworkError(err, stderr)
+		})
 
 		// TODO: Better handling of empty repositories
 		if err != nil && strings.Contains(err.Error(), "no such ref was fetched") {
 			logProgess(repo, "Finished (empty repository)", 1)
-			return
-		} else {
-			check(err)
+			return nil
+		} else if err != nil {
+			return networkErrorf("fetching: %w", err)
 		}
+	}
 
-		latestBranch = repo.getCurrentBranch()
-		_, _, err = runGitSync(repo.Path, "reset", "--hard", "origin/"+latestBranch)
-		check(err)
+	err := repo.detectObjectFormat()
+	if err != nil {
+		return err
 	}
 
-	repo.VendoredFilters = repo.vendoredFilters()
-	repo.updateFiles()
+	latestBranch, err := repo.checkoutRef()
+	if err != nil {
+		return err
+	}
 
-	if len(latestBranch) == 0 {
-		latestBranch = repo.getCurrentBranch()
+	repo.VendoredFilters = repo.vendoredFilters()
+	err = repo.updateFiles()
+	if err != nil {
+		return err
 	}
 
 	repo.CurrentBranch = latestBranch
 	repo.LatestBranch = latestBranch
 
-	latestCommit := repo.getLatestCommit()
+	latestCommit, err := repo.getLatestCommit()
+	if err != nil {
+		return err
+	}
+
 	repo.CurrentCommit = latestCommit
 	repo.LatestCommit = latestCommit
+	return nil
 }
 
-func (repo *Repo) isPathVendored(path string) bool {
-	for _, filter := range repo.VendoredFilters {
-		if filter.MatchString(path) {
-			return true
+// Checks out config.repositories[].ref, or the remote's default branch if no
+// ref was provided. Branches are reset to match origin, tags and commits are
+// checked out detached. Returns the ref that was checked out.
+func (repo *Repo) checkoutRef() (string, error) {
+	ref := repo.Config.Ref
+
+	if len(ref) == 0 {
+		var err error
+		ref, err = repo.getDefaultBranch()
+		if err != nil {
+			return "", err
 		}
 	}
 
-	return false
+	// Freshly cloned empty repositories have nothing to check out
+	if _, _, err := runGitSync(repo.ctx, repo.Path, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return ref, nil
+	}
+
+	var err error
+	if repo.isRemoteBranch(ref) {
+		log(Info, repo, fmt.Sprintf("Checking out branch %s", ref))
+		_, _, err = runGitSync(repo.ctx, repo.Path, "checkout", "--force", "-B", ref, "origin/"+ref)
+	} else {
+		log(Info, repo, fmt.Sprintf("Checking out ref %s", ref))
+		_, _, err = runGitSync(repo.ctx, repo.Path, "checkout", "--force", "--detach", ref)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("checking out %s: %w", ref, err)
+	}
+
+	return ref, nil
 }
 
-func (repo *Repo) shouldSkipFileByName(repoFile string) bool {
-	if config.Ignore.EnryVendor && enry.IsVendor(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping enry vendored file %s", repoFile))
-		return true
+// Detects whether the repository uses SHA-1 or SHA-256 object IDs, and
+// computes the ID of the empty tree root commits are diffed against.
+func (repo *Repo) detectObjectFormat() error {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "rev-parse", "--show-object-format")
+	if err != nil {
+		return fmt.Errorf("detecting the object format: %w", err)
 	}
+	repo.ObjectFormat = strings.Trim(stdout, "\n\r\t ")
 
-	if config.Ignore.LinguistVendor && repo.isPathVendored(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping linguist-vendored file %s", repoFile))
-		return true
+	stdout, _, err = runGitSync(repo.ctx, repo.Path, "hash-object", "-t", "tree", os.DevNull)
+	if err != nil {
+		return fmt.Errorf("hashing the empty tree: %w", err)
 	}
+	repo.EmptyTree = strings.Trim(stdout, "\n\r\t ")
 
-	if config.Ignore.Dotfiles && enry.IsDotFile(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping dotfile file %s", repoFile))
-		return true
+	log(Info, repo, fmt.Sprintf("Using object format %s, empty tree %s", repo.ObjectFormat, repo.EmptyTree))
+	return nil
+}
+
+func (repo *Repo) getDefaultBranch() (string, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+
+	if err != nil {
+		if ctxErr := repo.ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+
+		log(Warning, repo, "Unable to determine the default branch of origin, using the current branch")
+		return repo.getCurrentBranch()
 	}
 
-	if config.Ignore.Configuration && enry.IsConfiguration(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping config file %s", repoFile))
-		return true
+	return strings.TrimPrefix(strings.Trim(stdout, "\n\r\t "), "origin/"), nil
+}
+
+func (repo *Repo) isRemoteBranch(ref string) bool {
+	_, _, err := runGitSync(repo.ctx, repo.Path, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+ref)
+
+	return err == nil
+}
+
+// Returns the linguist-vendored pattern from .gitattributes matching path.
+func (repo *Repo) vendoredMatch(path string) (string, bool) {
+	for _, filter := range repo.VendoredFilters {
+		if filter.MatchString(path) {
+			return filter.String(), true
+		}
 	}
 
-	if config.Ignore.Image && enry.IsImage(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping image file %s", repoFile))
-		return true
+	return "", false
+}
+
+// A rule which excludes matching files from the counts when enabled
+type fileRule struct {
+	// The option enabling the rule, e.g. ignore.test
+	option  string
+	enabled bool
+	// What the rule matches, for log messages
+	kind string
+	// Whether the file matches, and the pattern it matched if any. data is nil
+	// for rules which only consider the path.
+	match func(file string, data []byte) (bool, string)
+}
+
+func enryRule(check func(string) bool) func(string, []byte) (bool, string) {
+	return func(file string, _ []byte) (bool, string) { return check(file), "" }
+}
+
+// Rules which only consider the path of a file, in the order they are applied
+func (repo *Repo) nameRules() []fileRule {
+	ignore := repo.Config.Ignore
+
+	return []fileRule{
+		{"ignore.enryvendor", ignore.EnryVendor, "enry vendored file", enryRule(enry.IsVendor)},
+		{"ignore.linguistvendor", ignore.LinguistVendor, "linguist-vendored file", func(file string, _ []byte) (bool, string) {
+			pattern, ok := repo.vendoredMatch(file)
+			return ok, pattern
+		}},
+		{"ignore.dotfiles", ignore.Dotfiles, "dotfile", enryRule(enry.IsDotFile)},
+		{"ignore.configuration", ignore.Configuration, "config file", enryRule(enry.IsConfiguration)},
+		{"ignore.image", ignore.Image, "image file", enryRule(enry.IsImage)},
+		{"ignore.test", ignore.Test, "test file", enryRule(enry.IsTest)},
+		{"excludes", len(repo.Config.excludes) != 0, "file", func(file string, _ []byte) (bool, string) {
+			for _, regex := range repo.Config.excludes {
+				if regex.MatchString(file) {
+					return true, regex.String()
+				}
+			}
+
+			return false, ""
+		}},
 	}
+}
+
+// Rules which consider the contents of a file, applied after nameRules
+func (repo *Repo) dataRules() []fileRule {
+	ignore := repo.Config.Ignore
+
+	return []fileRule{
+		{"ignore.binary", ignore.Binary, "binary file", func(_ string, data []byte) (bool, string) {
+			return enry.IsBinary(data), ""
+		}},
+		{"ignore.generated", ignore.Generated, "generated file", func(file string, data []byte) (bool, string) {
+			return enry.IsGenerated(file, data), ""
+		}},
+	}
+}
+
+// Returns whether any enabled rule matches, logging the first which does.
+func (repo *Repo) matchRules(rules []fileRule, file string, data []byte) bool {
+	for _, rule := range rules {
+		if !rule.enabled {
+			continue
+		}
+
+		matched, pattern := rule.match(file, data)
+		if !matched {
+			continue
+		}
+
+		if len(pattern) != 0 {
+			log(Info, repo, fmt.Sprintf("Skipping %s %s, matched %s %s", rule.kind, file, rule.option, pattern))
+		} else {
+			log(Info, repo, fmt.Sprintf("Skipping %s %s", rule.kind, file))
+		}
 
-	if config.Ignore.Test && enry.IsTest(repoFile) {
-		log(Info, repo, fmt.Sprintf("Skipping test file %s", repoFile))
 		return true
 	}
 
 	return false
 }
 
+func (repo *Repo) shouldSkipFileByName(repoFile string) bool {
+	return repo.matchRules(repo.nameRules(), repoFile, nil)
+}
+
 func (repo *Repo) skipFileByData(repoFile string, data []byte) bool {
-	if config.Ignore.Binary && enry.IsBinary(data) {
-		log(Info, repo, fmt.Sprintf("Skipping binary file %s", repoFile))
-		return true
+	return repo.matchRules(repo.dataRules(), repoFile, data)
+}
+
+// Returns the entry of config.languages matching the file, if any.
+func (repo *Repo) languageOverride(repoFile string) (langOverride, bool) {
+	for _, override := range repo.Config.languages {
+		if override.regex.MatchString(repoFile) {
+			return override, true
+		}
 	}
 
-	if config.Ignore.Generated && enry.IsGenerated(repoFile, data) {
-		log(Info, repo, fmt.Sprintf("Skipping generated file %s", repoFile))
-		return true
+	return langOverride{}, false
+}
+
+func (repo *Repo) getLanguages(repoFile string, data []byte) []string {
+	if override, ok := repo.languageOverride(repoFile); ok {
+		log(Info, repo, fmt.Sprintf("Using language %s for file %s, matched override %s", override.lang, repoFile, override.regex.String()))
+		return []string{override.lang}
 	}
 
-	return false
+	return enry.GetLanguages(repoFile, data)
 }
 
-func (repo *Repo) count() map[string]*LineBytePair {
-	ret := map[string]*LineBytePair{}
+func (repo *Repo) shouldSkipLang(lang string) bool {
+	return shouldSkipLang(lang) || slices.Contains(repo.Config.Ignore.Langs, lang)
+}
 
-	flen := float64(len(repo.Files))
-	for i, repoFile := range repo.Files {
-		if len(repoFile) == 0 {
-			continue
+// Counts every line of the checked out tree. Results are cached per
+// repository by tree hash, and per file by blob hash, so only files which
+// changed since the last run are read again.
+func (repo *Repo) count() (map[string]*LineBytePair, error) {
+	tree, err := repo.getTreeID()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.SnapshotTree = tree
+
+	var oldCache map[string]SnapshotFile
+	if repo.cacheUsable("snapshot", snapshotCacheSettings) {
+		if repo.oldRepo.SnapshotTree == repo.SnapshotTree {
+			log(Info, repo, fmt.Sprintf("Tree %s is unchanged, using cached counts", repo.SnapshotTree))
+			repo.SnapshotCache = repo.oldRepo.SnapshotCache
+			repo.LangCounts = repo.oldRepo.LangCounts
+			logProgess(repo, "Finished (cached)", 1)
+
+			return repo.LangCounts, nil
 		}
 
-		msg := fmt.Sprintf("Counting file %s", repoFile)
-		logProgess(repo, msg, float64(i)/flen)
-		log(Info, repo, msg)
+		oldCache = repo.oldRepo.SnapshotCache
+	}
 
-		fpath := path.Join(repo.Path, repoFile)
+	ret := map[string]*LineBytePair{}
+	repo.SnapshotCache = map[string]SnapshotFile{}
 
-		if repo.shouldSkipFileByName(repoFile) {
-			continue
+	entries, err := repo.getTreeEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	elen := float64(len(entries))
+	cached := 0
+
+	for i, entry := range entries {
+		if err := repo.ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		data, err := os.ReadFile(fpath)
-		check(err)
+		msg := fmt.Sprintf("Counting file %s", entry.File)
+		logProgess(repo, msg, float64(i)/elen)
+		log(Info, repo, msg)
 
-		if repo.skipFileByData(repoFile, data) {
+		if repo.shouldSkipFileByName(entry.File) {
 			continue
 		}
 
-		langs := enry.GetLanguages(repoFile, data)
-		if len(langs) > 1 {
-			log(Warning, repo, fmt.Sprintf("Potentially multiple languages found for file %s: %s", fpath, langs))
+		key := entry.Blob + " " + entry.File
+		result, ok := oldCache[key]
+
+		if ok {
+			cached++
+		} else {
+			result, err = repo.countFile(entry.File)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		if len(langs) == 0 {
-			langs = append(langs, "Unknown")
+		repo.SnapshotCache[key] = result
+
+		if result.Skipped {
+			continue
 		}
 
-		pair := ret[langs[0]]
+		pair := ret[result.Lang]
 		if pair == nil {
 			pair = &LineBytePair{}
-			ret[langs[0]] = pair
+			ret[result.Lang] = pair
 		}
 
-		pair.Lines += bytes.Count(data, []byte{'\n'})
-		pair.Bytes += len([]byte(data))
+		pair.Lines += result.Lines
+		pair.Bytes += result.Bytes
 	}
 
-	log(Info, repo, "Finished")
-	logProgess(repo, "Finished", 1)
+	msg := fmt.Sprintf("Finished (%d cached, %d counted)", cached, len(repo.SnapshotCache)-cached)
+	log(Info, repo, msg)
+	logProgess(repo, msg, 1)
 
-	return ret
+	repo.LangCounts = ret
+	return ret, nil
 }
 
-func commitHashesEqual(a []string, b []string) bool {
-	if len(a) != len(b) {
-		return false
+// Reads and classifies a single file of the checked out tree.
+func (repo *Repo) countFile(file string) (SnapshotFile, error) {
+	fpath := path.Join(repo.Path, file)
+
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return SnapshotFile{}, err
 	}
 
-	for i := range a {
-		if a[i] != b[i] {
-			return false
-		}
+	if repo.skipFileByData(file, data) {
+		return SnapshotFile{Skipped: true}, nil
+	}
+
+	langs := repo.getLanguages(file, data)
+	if len(langs) > 1 {
+		log(Warning, repo, fmt.Sprintf("Potentially multiple languages found for file %s: %s", fpath, langs))
+	}
+
+	if len(langs) == 0 {
+		langs = append(langs, "Unknown")
 	}
 
-	return true
+	return SnapshotFile{
+		Lang:  langs[0],
+		Lines: bytes.Count(data, []byte{'\n'}),
+		Bytes: len(data),
+	}, nil
 }
 
-func (repo *Repo) countByCommit() map[string]*LineBytePair {
-	commits := repo.getMatchingCommits()
+func (repo *Repo) countByCommit() (map[string]*LineBytePair, error) {
+	commits, err := repo.getMatchingCommits()
+	if err != nil {
+		return nil, err
+	}
 	clen := float64(len(commits))
 
-	// Sort commits to be compared with old commits
 	for _, commit := range commits {
 		if !commit.shouldSkipCommit() {
 			repo.CommitHashesOrdered = append(repo.CommitHashesOrdered, commit.Hash)
+			repo.CommitTimestamps[commit.Hash] = commit.Timestamp
 		}
 	}
 
-	// Check if we have old data and can just
-	if repo.oldRepo != nil {
-		if commitHashesEqual(repo.CommitHashesOrdered, repo.oldRepo.CommitHashes) {
-			repo.CommitCounts = repo.oldRepo.LangCounts
-			log(Info, repo, "Finished (Old Data)")
-			logProgess(repo, "Finished (Old Data)", 1)
-			repo.LangCounts = repo.oldRepo.LangCounts
-			repo.UniqueFileCount = repo.oldRepo.UniqueFileCount
-			repo.CommitCounts = repo.oldRepo.CommitCounts
-			return repo.oldRepo.LangCounts
-		}
+	repo.CommitCache = map[string]*CommitResult{}
+
+	var oldCache map[string]*CommitResult
+	if repo.cacheUsable("commits", commitCacheSettings) {
+		oldCache = repo.oldRepo.CommitCache
 	}
 
 	ret := map[string]*LineBytePair{}
+	cached := 0
 
 	for i, commit := range commits {
+		if err := repo.ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		if commit.shouldSkipCommit() {
-			log(Info, repo, fmt.Sprintf("Skipping commit %s", commit.Hash))
+			repo.skipCommit(commit, "listed in config.commits")
 			continue
 		}
 
-		msg := fmt.Sprintf("Checking out commit %s", commit.Hash)
-		logProgess(repo, msg, float64(i)/clen)
-		log(Info, repo, msg)
-		repo.checkoutCommit(commit)
-
-		commitPair := &LineBytePair{}
-		repo.CommitCounts[commit.Hash] = commitPair
-
-		for _, diff := range commit.getDiffs(repo) {
-			if diff.shouldSkip(repo) {
-				continue
-			}
+		if pattern := repo.Config.Bulk.matchMessage(commit); len(pattern) != 0 {
+			repo.skipCommit(commit, fmt.Sprintf("subject matched bulk.messages pattern %s", pattern))
+			continue
+		}
 
-			langs := diff.getLanguages(repo)
-			if len(langs) > 1 {
-				log(Warning, repo, fmt.Sprintf("Potentially multiple languages found for file %s: %s", diff.File, langs))
+		result, ok := oldCache[commit.Hash]
+		if ok {
+			log(Info, repo, fmt.Sprintf("Using cached results for commit %s", commit.Hash))
+			cached++
+		} else {
+			msg := fmt.Sprintf("Checking out commit %s", commit.Hash)
+			logProgess(repo, msg, float64(i)/clen)
+			log(Info, repo, msg)
+			err = repo.checkoutCommit(commit)
+			if err == nil {
+				result, err = repo.analyzeCommit(commit)
 			}
 
-			if len(langs) == 0 {
-				langs = append(langs, "Unknown")
+			if err != nil {
+				return nil, err
 			}
+		}
 
-			if !shouldSkipLang(langs[0]) {
-				repo.insertUniqueFile(diff.File)
-			}
+		repo.CommitCache[commit.Hash] = result
+	}
 
-			pair := ret[langs[0]]
-			if pair == nil {
-				pair = &LineBytePair{}
-				ret[langs[0]] = pair
-			}
+	// Added once every commit is analyzed, as merges need the results of the
+	// commits they bring in
+	counted := map[string]*CommitResult{}
+	for _, commit := range commits {
+		result, ok := repo.CommitCache[commit.Hash]
+		if !ok {
+			continue
+		}
 
-			var lines int
-			var bytes int
-			if config.CountTotal {
-				lines = diff.Added.Lines - diff.Removed.Lines
-				bytes = diff.Added.Bytes - diff.Removed.Bytes
-			} else {
-				lines = diff.Added.Lines + diff.Removed.Lines
-				bytes = diff.Added.Bytes + diff.Removed.Bytes
+		if len(commit.Parents) > 1 && repo.Config.Merges == "first-parent" {
+			result, err = repo.dedupeMerge(commit, result, counted)
+			if err != nil {
+				return nil, err
 			}
-
-			pair.Lines += lines
-			pair.Bytes += bytes
-			commitPair.Lines += lines
-			commitPair.Bytes += bytes
 		}
+
+		counted[commit.Hash] = result
+		repo.addCommitResult(commit, result, ret)
 	}
 
 	msg := fmt.Sprintf("Checking out branch %s", repo.LatestBranch)
 	logProgess(repo, msg, 0.99)
 	log(Info, repo, msg)
-	repo.checkoutBranch(repo.LatestBranch)
+	err = repo.checkoutBranch(repo.LatestBranch)
+	if err != nil {
+		return nil, err
+	}
 
-	log(Info, repo, "Finished")
-	logProgess(repo, "Finished", 1)
+	msg = fmt.Sprintf("Finished (%d cached, %d analyzed)", cached, len(repo.CommitCache)-cached)
+	log(Info, repo, msg)
+	logProgess(repo, msg, 1)
 
 	repo.LangCounts = ret
-	return ret
+	return ret, nil
+}
+
+// Diffs the checked out commit, grouping its changes by language. Counts are
+// kept unweighted so the result can be cached independently of who matched.
+func (repo *Repo) analyzeCommit(commit Commit) (*CommitResult, error) {
+	allDiffs, err := commit.getDiffs(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []Diff{}
+	unfiltered := 0
+	for _, diff := range allDiffs {
+		if len(diff.File) != 0 {
+			unfiltered++
+		}
+
+		skip, err := diff.shouldSkip(repo)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s in commit %s: %w", diff.File, commit.Hash, err)
+		}
+
+		if !skip {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	result := &CommitResult{
+		Langs: map[string]*CommitLangResult{},
+	}
+
+	result.Scale, result.Reason = repo.Config.Bulk.scale(diffs, unfiltered)
+	if result.Scale == 0 {
+		return result, nil
+	}
+
+	for _, diff := range diffs {
+		langs, err := diff.getLanguages(repo)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s in commit %s: %w", diff.File, commit.Hash, err)
+		}
+
+		if len(langs) > 1 {
+			log(Warning, repo, fmt.Sprintf("Potentially multiple languages found for file %s: %s", diff.File, langs))
+		}
+
+		if len(langs) == 0 {
+			langs = append(langs, "Unknown")
+		}
+
+		langResult := result.Langs[langs[0]]
+		if langResult == nil {
+			langResult = &CommitLangResult{}
+			result.Langs[langs[0]] = langResult
+		}
+
+		langResult.Added.Lines += diff.Added.Lines
+		langResult.Added.Bytes += diff.Added.Bytes
+		langResult.Removed.Lines += diff.Removed.Lines
+		langResult.Removed.Bytes += diff.Removed.Bytes
+		langResult.Files = append(langResult.Files, diff.File)
+	}
+
+	return result, nil
+}
+
+// A merge diffed against its first parent includes every change brought in
+// from its other parents. The changes of commits brought in which are counted
+// on their own are subtracted per language, so they are not counted twice,
+// while work only found in the merge, or made by authors who are not matched,
+// still counts towards the merge.
+func (repo *Repo) dedupeMerge(commit Commit, result *CommitResult, counted map[string]*CommitResult) (*CommitResult, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "rev-list", commit.Hash, "--not", commit.Parents[0])
+	if err != nil {
+		return nil, fmt.Errorf("listing the commits merged by %s: %w", commit.Hash, err)
+	}
+
+	deduped := &CommitResult{
+		Langs:  map[string]*CommitLangResult{},
+		Scale:  result.Scale,
+		Reason: result.Reason,
+	}
+
+	for lang, langResult := range result.Langs {
+		copied := *langResult
+		deduped.Langs[lang] = &copied
+	}
+
+	subtracted := 0
+	for _, hash := range strings.Fields(stdout) {
+		merged, ok := counted[hash]
+		if hash == commit.Hash || !ok {
+			continue
+		}
+
+		for lang, mergedLang := range merged.Langs {
+			langResult, ok := deduped.Langs[lang]
+			if !ok {
+				continue
+			}
+
+			langResult.Added.Lines = max(0, langResult.Added.Lines-mergedLang.Added.Lines)
+			langResult.Added.Bytes = max(0, langResult.Added.Bytes-mergedLang.Added.Bytes)
+			langResult.Removed.Lines = max(0, langResult.Removed.Lines-mergedLang.Removed.Lines)
+			langResult.Removed.Bytes = max(0, langResult.Removed.Bytes-mergedLang.Removed.Bytes)
+		}
+
+		subtracted++
+	}
+
+	if subtracted != 0 {
+		log(Info, repo, fmt.Sprintf("Merge %s brings in %d commits counted on their own, subtracting their changes", commit.Hash, subtracted))
+	}
+
+	return deduped, nil
+}
+
+// Adds a fresh or cached commit result to the repository's counts, applying
+// config.counttotal, the commit's weight, and any bulk scaling.
+func (repo *Repo) addCommitResult(commit Commit, result *CommitResult, ret map[string]*LineBytePair) {
+	if result.Scale == 0 {
+		repo.skipCommit(commit, result.Reason)
+		return
+	} else if len(result.Reason) != 0 {
+		log(Info, repo, fmt.Sprintf("Capping commit %s to %.2f%% of its counts, %s", commit.Hash, result.Scale*100, result.Reason))
+	}
+
+	commitPair := &LineBytePair{}
+	repo.CommitCounts[commit.Hash] = commitPair
+	repo.CommitLangCounts[commit.Hash] = map[string]*LineBytePair{}
+
+	for lang, langResult := range result.Langs {
+		if !repo.shouldSkipLang(lang) {
+			for _, file := range langResult.Files {
+				repo.insertUniqueFile(file)
+			}
+		}
+
+		pair := ret[lang]
+		if pair == nil {
+			pair = &LineBytePair{}
+			ret[lang] = pair
+		}
+
+		lines, bytes := repo.commitLangCount(langResult, commit.Weight*result.Scale)
+
+		pair.Lines += lines
+		pair.Bytes += bytes
+		commitPair.Lines += lines
+		commitPair.Bytes += bytes
+		repo.CommitLangCounts[commit.Hash][lang] = &LineBytePair{Lines: lines, Bytes: bytes}
+	}
+}
+
+// The lines and bytes a language of a commit adds to the counts, applying
+// config.counttotal and weight.
+func (repo *Repo) commitLangCount(langResult *CommitLangResult, weight float64) (int, int) {
+	var lines int
+	var bytes int
+	if repo.Config.CountTotal {
+		lines = langResult.Added.Lines - langResult.Removed.Lines
+		bytes = langResult.Added.Bytes - langResult.Removed.Bytes
+	} else {
+		lines = langResult.Added.Lines + langResult.Removed.Lines
+		bytes = langResult.Added.Bytes + langResult.Removed.Bytes
+	}
+
+	return weigh(lines, weight), weigh(bytes, weight)
 }
 
-func (repo *Repo) getMatchingCommits() []Commit {
+func (repo *Repo) skipCommit(commit Commit, reason string) {
+	log(Info, repo, fmt.Sprintf("Skipping commit %s, %s", commit.Hash, reason))
+	repo.SkippedCommits[commit.Hash] = reason
+}
+
+func (repo *Repo) getMatchingCommits() ([]Commit, error) {
 	ret := []Commit{}
 
-	for _, author := range config.Authors {
-		commitsText, _, err := runGitSync(repo.Path, "log", "--author="+author, "--no-merges", "--pretty=format:%h %ct")
-		check(err)
-		commitsLines := strings.Split(commitsText, "\n")
+	// Without any revisions git log walks HEAD, which is the configured ref
+	limits := []string{}
+	if repo.Config.AllBranches {
+		limits = append(limits, "--remotes=origin")
+	}
+
+	if len(repo.Config.since) != 0 {
+		limits = append(limits, "--since="+repo.Config.since)
+	}
+
+	if len(repo.Config.until) != 0 {
+		limits = append(limits, "--until="+repo.Config.until)
+	}
+
+	// Fields are NUL separated and records end with a record separator, as
+	// names and trailers may contain spaces. %aN and %aE respect .mailmap.
+	format := "--pretty=format:%H%x00%ct%x00%P%x00%s%x00%aN%x00%aE%x00%(trailers:key=Co-authored-by,valueonly,separator=%x01)%x1e"
+	args := []string{"log", format}
+
+	// Commits brought in by a merge are walked in every mode, so that they
+	// match their own authors, first-parent merges are deduplicated once
+	// analyzed
+	if repo.Config.Merges == "skip" {
+		args = append(args, "--no-merges")
+	}
 
-		for _, line := range commitsLines {
-			split := strings.Fields(line)
+	args = append(args, limits...)
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing commits: %w", err)
+	}
+
+	type logEntry struct {
+		hash      string
+		timestamp uint64
+		parents   []string
+		subject   string
+		author    Identity
+		coAuthors []string
+	}
+
+	entries := []logEntry{}
+	contacts := []string{}
+
+	for _, record := range strings.Split(stdout, "\x1e") {
+		fields := strings.Split(strings.TrimLeft(record, "\n"), "\x00")
+
+		if len(fields) != 7 {
+			continue
+		}
 
-			if len(split) != 2 {
+		timestamp, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the timestamp of commit %s: %w", fields[0], err)
+		}
+
+		entry := logEntry{
+			hash:      fields[0],
+			timestamp: timestamp,
+			parents:   strings.Fields(fields[2]),
+			subject:   fields[3],
+			author:    Identity{Name: fields[4], Email: fields[5]},
+		}
+
+		if repo.Config.CoAuthors && len(fields[6]) != 0 {
+			entry.coAuthors = strings.Split(fields[6], "\x01")
+
+			for _, contact := range entry.coAuthors {
+				if !slices.Contains(contacts, contact) {
+					contacts = append(contacts, contact)
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	coAuthors := repo.mapIdentities(contacts)
+
+	for _, entry := range entries {
+		if author, ok := repo.matchAuthor(entry.author); ok {
+			log(Info, repo, fmt.Sprintf("Commit %s authored by %s, matched author %s", entry.hash, entry.author, author))
+
+			commit := makeCommit(entry.hash, entry.timestamp, entry.parents)
+			commit.Subject = entry.subject
+			commit.Identity = entry.author.String()
+			ret = commitsInsertSortedUnique(ret, commit)
+			continue
+		}
+
+		for _, contact := range entry.coAuthors {
+			identity, ok := coAuthors[contact]
+			if !ok {
 				continue
 			}
 
-			timestamp, err := strconv.ParseUint(split[1], 10, 64)
-			check(err)
-			ret = commitsInsertSortedUnique(ret, makeCommit(repo, split[0], timestamp))
+			if author, ok := repo.matchAuthor(identity); ok {
+				log(Info, repo, fmt.Sprintf(
+					"Commit %s co-authored by %s, matched author %s, weighted by %g",
+					entry.hash,
+					identity,
+					author,
+					repo.Config.CoAuthorWeight,
+				))
+
+				commit := makeCommit(entry.hash, entry.timestamp, entry.parents)
+				commit.Subject = entry.subject
+				commit.Identity = identity.String()
+				commit.Weight = repo.Config.CoAuthorWeight
+				ret = commitsInsertSortedUnique(ret, commit)
+				break
+			}
 		}
 	}
 
-	return ret
+	return ret, nil
 }
 
-func (repo *Repo) getLatestCommit() Commit {
-	stdout, _, err := runGitSync(repo.Path, "log", "-n", "1", "--pretty=format:%h %ct")
+func (repo *Repo) getLatestCommit() (Commit, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "log", "-n", "1", "--pretty=format:%H %ct %P")
 	if err != nil && strings.Contains(err.Error(), "does not have any commits yet") {
-		return Commit{}
-	} else {
-		check(err)
+		return Commit{}, nil
+	} else if err != nil {
+		return Commit{}, fmt.Errorf("reading the latest commit: %w", err)
 	}
 
 	commitLine := strings.Trim(stdout, "\t\n\r ")
 	split := strings.Fields(commitLine)
+	if len(split) < 2 {
+		return Commit{}, fmt.Errorf("unexpected output reading the latest commit: %q", commitLine)
+	}
 
 	timestamp, err := strconv.ParseUint(split[1], 10, 64)
-	check(err)
+	if err != nil {
+		return Commit{}, fmt.Errorf("parsing the timestamp of commit %s: %w", split[0], err)
+	}
 
-	return makeCommit(repo, split[0], timestamp)
+	return makeCommit(split[0], timestamp, split[2:]), nil
 }
 
-func (repo *Repo) getCurrentBranch() string {
-	stdout, _, err := runGitSync(repo.Path, "branch", "--show-current")
-	check(err)
+// Reads a single commit and its author, as resolved through .mailmap. rev
+// may be any revision naming a commit.
+func (repo *Repo) getCommit(rev string) (Commit, string, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "log", "-n", "1", "--pretty=format:%H%x00%ct%x00%P%x00%s%x00%aN <%aE>", rev, "--")
+	if err != nil {
+		return Commit{}, "", fmt.Errorf("reading commit %s: %w", rev, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(stdout), "\x00")
+	if len(fields) != 5 {
+		return Commit{}, "", fmt.Errorf("unexpected output reading commit %s: %q", rev, stdout)
+	}
+
+	timestamp, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return Commit{}, "", fmt.Errorf("parsing the timestamp of commit %s: %w", fields[0], err)
+	}
+
+	commit := makeCommit(fields[0], timestamp, strings.Fields(fields[2]))
+	commit.Subject = fields[3]
 
-	return strings.Trim(stdout, "\n\r\t ")
+	return commit, fields[4], nil
 }
 
-func (repo *Repo) checkoutBranch(branch string) {
+func (repo *Repo) getTreeID() (string, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "rev-parse", "HEAD^{tree}")
+	if err != nil {
+		return "", fmt.Errorf("reading the tree of HEAD: %w", err)
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+func (repo *Repo) getCurrentBranch() (string, error) {
+	stdout, _, err := runGitSync(repo.ctx, repo.Path, "branch", "--show-current")
+	if err != nil {
+		return "", fmt.Errorf("reading the current branch: %w", err)
+	}
+
+	return strings.Trim(stdout, "\n\r\t "), nil
+}
+
+func (repo *Repo) checkoutBranch(branch string) error {
 	if repo.CurrentBranch == branch {
-		return
+		return nil
 	}
 
-	_, _, err := runGitSync(repo.Path, "checkout", branch)
-	check(err)
+	_, _, err := runGitSync(repo.ctx, repo.Path, "checkout", branch)
+	if err != nil {
+		return fmt.Errorf("checking out branch %s: %w", branch, err)
+	}
 
 	repo.CurrentBranch = branch
-	repo.CurrentCommit = repo.getLatestCommit()
+	repo.CurrentCommit, err = repo.getLatestCommit()
+	if err != nil {
+		return err
+	}
 
-	repo.updateFiles()
+	return repo.updateFiles()
 }
 
-func (repo *Repo) checkoutCommit(commit Commit) {
-	if repo.CurrentCommit == commit {
+// Returns the repository to its branch after counting was interrupted or
+// failed. The repository's context may be cancelled, so this uses its own.
+func (repo *Repo) restoreBranch() {
+	if len(repo.LatestBranch) == 0 || repo.CurrentBranch == repo.LatestBranch {
+		return
+	}
+
+	log(Info, repo, fmt.Sprintf("Reverting to branch %s", repo.LatestBranch))
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(repo.ctx), time.Minute)
+	defer cancel()
+
+	_, _, err := runGitSync(ctx, repo.Path, "checkout", "--force", repo.LatestBranch)
+	if err != nil {
+		log(Critical, repo, fmt.Sprintf("Failed to revert to branch %s: %s", repo.LatestBranch, err))
 		return
 	}
 
-	_, _, err := runGitSync(repo.Path, "checkout", commit.Hash)
-	check(err)
+	repo.CurrentBranch = repo.LatestBranch
+}
+
+func (repo *Repo) checkoutCommit(commit Commit) error {
+	if repo.CurrentCommit.Hash == commit.Hash {
+		return nil
+	}
+
+	_, _, err := runGitSync(repo.ctx, repo.Path, "checkout", commit.Hash)
+	if err != nil {
+		return fmt.Errorf("checking out commit %s: %w", commit.Hash, err)
+	}
 
 	repo.CurrentCommit = commit
 	repo.CurrentBranch = ""
 
-	repo.updateFiles()
+	return repo.updateFiles()
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const RETRYDELAY = 2 * time.Second
+const RETRYMAXDELAY = time.Minute
+
+// Messages in git's output which point to a network problem, rather than e.g.
+// a repository which does not exist
+var transientGitMessages = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"failed to connect",
+	"connection refused",
+	"connection reset",
+	"connection timed out",
+	"operation timed out",
+	"early eof",
+	"rpc failed",
+	"the remote end hung up unexpectedly",
+	"gnutls_handshake() failed",
+	"ssl_error_syscall",
+	"the requested url returned error: 429",
+	"the requested url returned error: 5",
+}
+
+// Marks err as transient if git's stderr shows it was caused by the network.
+func gitNetworkError(err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+
+	lower := strings.ToLower(stderr)
+	for _, msg := range transientGitMessages {
+		if strings.Contains(lower, msg) {
+			return &TransientError{Err: err}
+		}
+	}
+
+	return err
+}
+
+func isTransient(err error) bool {
+	var transient *TransientError
+	return errors.As(err, &transient)
+}
+
+// Runs fn, retrying it up to config.retries times while it fails with a
+// transient error. The delay between attempts starts at RETRYDELAY and doubles
+// each time, up to RETRYMAXDELAY, and is extended to the wait the error asks
+// for within the same limit. what names the operation in log messages, and
+// repo may be nil for operations outside of a repository.
+func retry(ctx context.Context, repo *Repo, what string, fn func() error) error {
+	attempts := *config.Retries + 1
+	delay := RETRYDELAY
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt == attempts {
+			if attempts == 1 {
+				return err
+			}
+
+			return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+		}
+
+		var transient *TransientError
+		if errors.As(err, &transient) && transient.Wait > delay {
+			delay = min(transient.Wait, RETRYMAXDELAY)
+		}
+
+		// Progress is displayed for repositories, so only echo the others
+		logEcho(Warning, repo, fmt.Sprintf("%s failed (attempt %d of %d), retrying in %s: %s", what, attempt, attempts, delay, err), repo == nil)
+		if repo != nil {
+			logProgess(repo, fmt.Sprintf("%s failed, retrying in %s (attempt %d of %d)", what, delay, attempt+1, attempts), 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, RETRYMAXDELAY)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Set once SIGINT or SIGTERM is received
+var interrupted atomic.Bool
+
+// Cancels work on SIGINT or SIGTERM. Until the lock is held there is nothing
+// to clean up, so the terminal is restored and the process exits right away.
+// Afterwards cancel is called so that workers can restore their branches and
+// the state can be written, and a second signal exits immediately.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		interrupted.Store(true)
+
+		if !lockHeld.Load() {
+			logResetCursor()
+			os.Exit(ExitInterrupted)
+		}
+
+		logEcho(Warning, nil, fmt.Sprintf("Received %s, stopping. Send it again to exit immediately", sig), true)
+		cancel()
+
+		<-signals
+		logResetTermIfNeeded()
+
+		if err := unlock(); err != nil {
+			logEcho(Critical, nil, fmt.Sprintf("Failed to remove lockfile: %s", err), true)
+		}
+
+		os.Exit(ExitInterrupted)
+	}()
+}
@@ -134,7 +134,7 @@ func indent(s string, by int) string {
 	return builder.String()
 }
 
-func createSVG(langs map[string]*LineBytePair, totalFiles int) {
+func createSVG(langs map[string]*LineBytePair, totalFiles int) error {
 	svgTmplFuncMap = template.FuncMap{
 		"indent": indent,
 	}
@@ -156,23 +156,23 @@ func createSVG(langs map[string]*LineBytePair, totalFiles int) {
 			continue
 		}
 
-		lt := LineBytePairForLang{
+		langsSorted = append(langsSorted, LineBytePairForLang{
 			lang:  k,
 			lines: v.Lines,
 			bytes: v.Bytes,
-		}
-		idx, found := slices.BinarySearchFunc(langsSorted, lt, func(lp1 LineBytePairForLang, lp2 LineBytePairForLang) int {
-			return cmp.Compare(lp1.lines, lp2.lines)
 		})
-
-		if !found {
-			langsSorted = slices.Insert(langsSorted, idx, lt)
-		}
 	}
 
-	langsLen := len(langs)
-	keep := min(langsLen, config.LangsCount)
-	slices.Reverse(langsSorted)
+	// Largest first, languages with the same count by name so that none are
+	// dropped and the order is stable between runs
+	slices.SortFunc(langsSorted, func(lp1 LineBytePairForLang, lp2 LineBytePairForLang) int {
+		return cmp.Or(
+			cmp.Compare(lp2.lines, lp1.lines),
+			cmp.Compare(lp1.lang, lp2.lang),
+		)
+	})
+
+	keep := min(len(langsSorted), config.LangsCount)
 	langsSorted = langsSorted[:keep]
 
 	totals := Totals{
@@ -185,17 +185,25 @@ func createSVG(langs map[string]*LineBytePair, totalFiles int) {
 	}
 
 	outputFile, err := os.Create(outputPath)
-	check(err)
-	defer outputFile.Close()
+	if err != nil {
+		return err
+	}
 
 	switch strings.ToLower(config.Style.Type) {
 	case "vertical":
-		createVertical(totals, langsSorted, outputFile)
+		err = createVertical(totals, langsSorted, outputFile)
 	case "compact":
-		createCompact(totals, langsSorted, outputFile)
+		err = createCompact(totals, langsSorted, outputFile)
 	default:
-		panic(fmt.Sprintf("Unknown style %s", config.Style.Type))
+		err = configErrorf("unknown config.style.type %s", config.Style.Type)
 	}
+
+	if err != nil {
+		outputFile.Close()
+		return err
+	}
+
+	return outputFile.Close()
 }
 
 type SVGData struct {
@@ -338,29 +346,32 @@ const SVGTEMPLATESTRING = `<svg width="{{ .Width }}" height="{{ .Height }}" view
 </svg>
 `
 
-func processEntries[T any](tmpl *template.Template, data []T) string {
+func processEntries[T any](tmpl *template.Template, data []T) (string, error) {
 	builder := new(strings.Builder)
 	dlen := len(data)
 
 	for i, entry := range data {
 		err := tmpl.Execute(builder, entry)
-		check(err)
+		if err != nil {
+			return "", err
+		}
 
 		if i != dlen-1 {
 			builder.WriteByte('\n')
 		}
 	}
 
-	return builder.String()
+	return builder.String(), nil
 }
 
-func processTemplate(data SVGData, writer io.Writer) {
+func processTemplate(data SVGData, writer io.Writer) error {
 	data.Theme = theme
 	tmpl, err := template.New("svg").Funcs(svgTmplFuncMap).Parse(SVGTEMPLATESTRING)
-	check(err)
+	if err != nil {
+		return err
+	}
 
-	err = tmpl.Execute(writer, data)
-	check(err)
+	return tmpl.Execute(writer, data)
 }
 
 type CompactEntryData struct {
@@ -377,7 +388,7 @@ type CompactEntryData struct {
 	Color      string
 }
 
-func createCompact(totals Totals, langsSorted []LineBytePairForLang, outputFile *os.File) {
+func createCompact(totals Totals, langsSorted []LineBytePairForLang, outputFile *os.File) error {
 	const MASK = `<mask id="rect-mask">
 	<rect x="%d" y="0" width="%d" height="8" fill="white" rx="5" />
 </mask>` + "\n"
@@ -393,7 +404,9 @@ func createCompact(totals Totals, langsSorted []LineBytePairForLang, outputFile
 </g>`
 
 	tmpl, err := template.New("entry").Funcs(entryTmplFuncMap).Parse(SVGENTRY)
-	check(err)
+	if err != nil {
+		return err
+	}
 
 	var width int
 
@@ -447,13 +460,18 @@ func createCompact(totals Totals, langsSorted []LineBytePairForLang, outputFile
 		subHeader = fmtTotals(totals)
 	}
 
-	processTemplate(SVGData{
+	rendered, err := processEntries(tmpl, entries)
+	if err != nil {
+		return err
+	}
+
+	return processTemplate(SVGData{
 		Width:     width,
 		Height:    int(math.Ceil((float64(count)/2.0)))*20 + heightConst,
 		TitleX:    width / 2,
 		BodyY:     bodyY,
 		SubHeader: subHeader,
-		Entries:   fmt.Sprintf(MASK, rectXInitial, totalRectW) + processEntries(tmpl, entries),
+		Entries:   fmt.Sprintf(MASK, rectXInitial, totalRectW) + rendered,
 		Styles: `.header, .subheader { text-anchor: middle; }
 .lang-name, .lang-perc, .lang-count { dominant-baseline: middle; }
 .lang-perc, .lang-count { text-anchor: end; }`,
@@ -472,7 +490,7 @@ type VerticalEntryData struct {
 	Color     string
 }
 
-func createVertical(totals Totals, langsSorted []LineBytePairForLang, outputFile *os.File) {
+func createVertical(totals Totals, langsSorted []LineBytePairForLang, outputFile *os.File) error {
 	const SVGENTRY = `<g transform="translate({{ .XOffset }}, {{ .YOffset }})">
 	<g class="stagger" style="animation-delay: {{ .Delay }}ms">
 		<text data-testid="lang-name" x="2" y="15" class="lang-name">{{ .LangName }} <tspan class="lang-count">({{ .CountStr }})</tspan></text>
@@ -488,7 +506,9 @@ func createVertical(totals Totals, langsSorted []LineBytePairForLang, outputFile
 </g>`
 
 	tmpl, err := template.New("entry").Parse(SVGENTRY)
-	check(err)
+	if err != nil {
+		return err
+	}
 
 	count := len(langsSorted)
 	entries := make([]VerticalEntryData, count)
@@ -518,13 +538,18 @@ func createVertical(totals Totals, langsSorted []LineBytePairForLang, outputFile
 		subHeader = fmtTotals(totals)
 	}
 
-	processTemplate(SVGData{
+	rendered, err := processEntries(tmpl, entries)
+	if err != nil {
+		return err
+	}
+
+	return processTemplate(SVGData{
 		Width:     300,
 		Height:    count*40 + heightConst,
 		TitleX:    25,
 		BodyY:     bodyY,
 		SubHeader: subHeader,
-		Entries:   processEntries(tmpl, entries),
+		Entries:   rendered,
 		Styles:    `.subheader { dominant-baseline: middle; }`,
 	}, outputFile)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+func themesMain(args []string) {
+	var dir string
+
+	fs := newFlagSet("themes", `
+List the themes in a directory, for use as config.style.theme
+
+Usage: ./ppebtrics themes [OPTIONS]
+ -h|--help             Display this message and exit
+ -d|--dir              Directory to list, defaults to ./themes
+`)
+
+	stringFlag(fs, &dir, "dir", "d", "./themes")
+	rejectPositional("themes", parseFlags(fs, args))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		exitWithError(configErrorf("listing themes: %w", err))
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		ext := path.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "THEME\tPATH\tCARDBG\tHEADER\tLANGNAME\tPERCENT")
+
+	for _, name := range names {
+		tpath := path.Join(dir, name)
+		tname := strings.TrimSuffix(name, path.Ext(name))
+
+		data, err := os.ReadFile(tpath)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\tunreadable: %s\n", tname, tpath, err)
+			continue
+		}
+
+		t := SVGTheme{}
+		if err := decodeStrict(tpath, data, &t); err != nil {
+			fmt.Fprintf(w, "%s\t%s\tinvalid: %s\n", tname, tpath, err)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", tname, tpath, t.CardBG, t.Header, t.LangName, t.Percent)
+	}
+
+	w.Flush()
+}
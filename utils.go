@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"os"
 	"slices"
 )
@@ -11,18 +12,22 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func isSymlink(path string) bool {
+func isSymlink(path string) (bool, error) {
 	info, err := os.Lstat(path)
-	check(err)
+	if err != nil {
+		return false, err
+	}
 
-	return info.Mode() == os.ModeSymlink
+	return info.Mode() == os.ModeSymlink, nil
 }
 
-func isDirectory(path string) bool {
+func isDirectory(path string) (bool, error) {
 	info, err := os.Stat(path)
-	check(err)
+	if err != nil {
+		return false, err
+	}
 
-	return info.IsDir()
+	return info.IsDir(), nil
 }
 
 func stringBeginsWith(str string, sub string) bool {
@@ -38,3 +43,7 @@ func stringBeginsWith(str string, sub string) bool {
 func shouldSkipLang(lang string) bool {
 	return lang == "Unknown" || lang == "Text" || lang == "Markdown" || slices.Contains(config.Ignore.Langs, lang)
 }
+
+func weigh(n int, weight float64) int {
+	return int(math.Round(float64(n) * weight))
+}
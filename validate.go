@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-enry/go-enry/v2"
+)
+
+func validateMain(args []string) {
+	fs := newFlagSet("validate", `
+Check the config and theme for mistakes without cloning or counting anything
+
+Usage: ./ppebtrics validate [OPTIONS]
+ -h|--help             Display this message and exit
+ -c|--config           Specify the path to your config.yml
+`)
+
+	configPath := configFlag(fs)
+	rejectPositional("validate", parseFlags(fs, args))
+
+	path := resolveConfigPath(*configPath)
+
+	err := loadConfig(path)
+	if err == nil {
+		err = initRepoConfigs()
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	problems := checkConfig()
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+
+	if len(problems) == 1 {
+		exitWithError(configErrorf("found 1 problem in %s", path))
+	} else if len(problems) != 0 {
+		exitWithError(configErrorf("found %d problems in %s", len(problems), path))
+	}
+
+	fmt.Printf("%s is valid\n", path)
+}
+
+// Checks which loading the config leaves out, as they are only mistakes in
+// the sense that an option does nothing. Every problem found is returned.
+func checkConfig() []string {
+	problems := []string{}
+
+	for _, pattern := range config.Filters {
+		if _, err := compilePattern(pattern, "filters"); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	problems = append(problems, checkLanguages("config", config.Ignore.Langs, config.Languages)...)
+
+	for _, id := range reposToCheck {
+		rc := repoConfigs[id]
+
+		// Repositories inherit the global values, which were checked above
+		langs := []string{}
+		for _, lang := range rc.Ignore.Langs {
+			if !slices.Contains(config.Ignore.Langs, lang) {
+				langs = append(langs, lang)
+			}
+		}
+
+		overrides := map[string]string{}
+		for pattern, lang := range rc.Languages {
+			if config.Languages[pattern] != lang {
+				overrides[pattern] = lang
+			}
+		}
+
+		problems = append(problems, checkLanguages(fmt.Sprintf("config.repositories[%s]", id), langs, overrides)...)
+	}
+
+	problems = append(problems, checkTheme(config.Style.Theme, theme)...)
+
+	for _, file := range []struct{ field, path string }{{"state", config.State}, {"history", config.History}} {
+		if info, err := os.Stat(file.path); err == nil && !info.Mode().IsRegular() {
+			problems = append(problems, fmt.Sprintf("config.%s (%s) is not a regular file", file.field, file.path))
+		}
+	}
+
+	if len(config.TokenFile) != 0 && !fileExists(config.TokenFile) {
+		problems = append(problems, fmt.Sprintf("config.tokenfile (%s) does not exist", config.TokenFile))
+	}
+
+	return problems
+}
+
+// Language names are matched exactly, so a name go-enry does not know, or an
+// alias such as golang, never matches a file.
+func checkLanguage(field string, lang string) (string, bool) {
+	if lang == "Unknown" {
+		return "", true
+	}
+
+	if _, ok := enry.GetLanguageID(lang); ok {
+		return "", true
+	}
+
+	if name, ok := enry.GetLanguageByAlias(lang); ok {
+		return fmt.Sprintf("%s: unknown language %q, did you mean %q?", field, lang, name), false
+	}
+
+	return fmt.Sprintf("%s: unknown language %q", field, lang), false
+}
+
+func checkLanguages(prefix string, langs []string, overrides map[string]string) []string {
+	problems := []string{}
+
+	for _, lang := range langs {
+		if problem, ok := checkLanguage(prefix+".ignore.langs", lang); !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	patterns := make([]string, 0, len(overrides))
+	for pattern := range overrides {
+		patterns = append(patterns, pattern)
+	}
+	slices.Sort(patterns)
+
+	for _, pattern := range patterns {
+		if problem, ok := checkLanguage(fmt.Sprintf("%s.languages[%s]", prefix, pattern), overrides[pattern]); !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+var colorRegexp = regexp.MustCompile(`^(#([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})|(rgb|rgba|hsl|hsla)\([^()]*\))$`)
+
+// The CSS named colors, along with the keywords SVG accepts as a paint
+var namedColors = strings.Fields(`
+	none transparent currentcolor
+	aliceblue antiquewhite aqua aquamarine azure beige bisque black
+	blanchedalmond blue blueviolet brown burlywood cadetblue chartreuse
+	chocolate coral cornflowerblue cornsilk crimson cyan darkblue darkcyan
+	darkgoldenrod darkgray darkgreen darkgrey darkkhaki darkmagenta
+	darkolivegreen darkorange darkorchid darkred darksalmon darkseagreen
+	darkslateblue darkslategray darkslategrey darkturquoise darkviolet
+	deeppink deepskyblue dimgray dimgrey dodgerblue firebrick floralwhite
+	forestgreen fuchsia gainsboro ghostwhite gold goldenrod gray green
+	greenyellow grey honeydew hotpink indianred indigo ivory khaki lavender
+	lavenderblush lawngreen lemonchiffon lightblue lightcoral lightcyan
+	lightgoldenrodyellow lightgray lightgreen lightgrey lightpink
+	lightsalmon lightseagreen lightskyblue lightslategray lightslategrey
+	lightsteelblue lightyellow lime limegreen linen magenta maroon
+	mediumaquamarine mediumblue mediumorchid mediumpurple mediumseagreen
+	mediumslateblue mediumspringgreen mediumturquoise mediumvioletred
+	midnightblue mintcream mistyrose moccasin navajowhite navy oldlace olive
+	olivedrab orange orangered orchid palegoldenrod palegreen paleturquoise
+	palevioletred papayawhip peachpuff peru pink plum powderblue purple
+	rebeccapurple red rosybrown royalblue saddlebrown salmon sandybrown
+	seagreen seashell sienna silver skyblue slateblue slategray slategrey
+	snow springgreen steelblue tan teal thistle tomato turquoise violet
+	wheat white whitesmoke yellow yellowgreen
+`)
+
+// Every color of the theme must be set to something an SVG fill accepts.
+func checkTheme(themePath string, t SVGTheme) []string {
+	problems := []string{}
+
+	v := reflect.ValueOf(t)
+	for i := range v.NumField() {
+		name := strings.ToLower(v.Type().Field(i).Name)
+		color := v.Field(i).String()
+
+		if len(color) == 0 {
+			problems = append(problems, fmt.Sprintf("theme %s is missing %s", themePath, name))
+		} else if !colorRegexp.MatchString(color) && !slices.Contains(namedColors, strings.ToLower(color)) {
+			problems = append(problems, fmt.Sprintf("theme %s: %s (%s) is not a color, use e.g. #7aa2f7, rgb(122, 162, 247), or a CSS color name", themePath, name, color))
+		}
+	}
+
+	return problems
+}